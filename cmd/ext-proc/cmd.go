@@ -1,7 +1,11 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	extproc "github.com/bladedancer/envoy-ext-proc/pkg/ext-proc"
 	"github.com/spf13/cobra"
@@ -11,21 +15,232 @@ import (
 
 // RootCmd configures the command params for the main line.
 var RootCmd = &cobra.Command{
-	Use:     "extprocdemo",
-	Short:   "Test External Processing routing.",
-	Version: "0.0.1",
-	RunE:    run,
+	Use:   "extprocdemo",
+	Short: "Test External Processing routing.",
+	RunE:  run,
 }
 
 func init() {
 	cobra.OnInitialize(initConfig)
 	RootCmd.Flags().Uint32("port", 10000, "The GRPC port to listen on.")
+	RootCmd.Flags().String("bindAddress", "0.0.0.0", "The address to bind the GRPC listener to.")
+	RootCmd.Flags().String("network", "tcp", "Listener network, tcp, tcp4 or tcp6 to force the address family.")
+	RootCmd.Flags().String("listen", "", "GRPC listener address, unix:///path/to/socket or tcp://host:port, instead of bindAddress and port.")
+	RootCmd.Flags().String("socketMode", "0660", "Permission of the unix socket, in octal.")
+	RootCmd.Flags().String("tlsCert", "", "TLS certificate file for the GRPC listener, empty for plaintext.")
+	RootCmd.Flags().String("tlsKey", "", "TLS private key file for tlsCert.")
+	RootCmd.Flags().String("tlsCA", "", "CA file client certificates must be signed by, enabling mTLS.")
+	RootCmd.Flags().StringSlice("tlsAllowedSPIFFEIDs", nil, "SPIFFE IDs (URI SANs) of client certificates allowed to connect, needs tlsCA.")
+	RootCmd.Flags().StringSlice("tlsAllowedDNSNames", nil, "DNS SANs of client certificates allowed to connect, needs tlsCA.")
+	RootCmd.Flags().String("tlsMinVersion", "1.2", "Minimum TLS version of the GRPC listener, 1.2 or 1.3.")
+	RootCmd.Flags().StringSlice("tlsCipherSuites", nil, "TLS 1.2 cipher suites allowed on the GRPC listener by Go name, empty for Go's defaults.")
+	RootCmd.Flags().Bool("dualStack", false, "Listen on both IPv4 and IPv6 (requires a wildcard bind address, not with reusePort).")
+	RootCmd.Flags().Int("maxStreams", 0, "Maximum number of streams open at once, further streams are rejected with Unavailable. 0 for no limit.")
+	RootCmd.Flags().String("overloadResponse", "grpc-error", "How streams over maxStreams are rejected, grpc-error or immediate-response.")
+	RootCmd.Flags().Int("overloadStatusCode", 503, "HTTP status of the overload immediate response.")
+	RootCmd.Flags().String("overloadRetryAfter", "", "Retry-After value sent with overload rejections, empty for none.")
+	RootCmd.Flags().Float64("perStreamMsgRate", 0, "Maximum messages per second processed for a single stream, excess is delayed. 0 for no limit.")
+	RootCmd.Flags().Int("workerPoolSize", 0, "Number of goroutines shared by all streams for decisions, 0 to decide on each stream's goroutine.")
+	RootCmd.Flags().Bool("reusePort", false, "Set SO_REUSEPORT on the GRPC listener so several instances can share the port.")
+	RootCmd.Flags().Uint32("debugPort", 0, "The HTTP port for debug endpoints, 0 disables them.")
+	RootCmd.Flags().Int("recentBlocks", 100, "Number of recent blocked requests kept for /recent-blocks.")
+	RootCmd.Flags().Duration("debugReadHeaderTimeout", 5*time.Second, "Time the debug server allows to read request headers.")
+	RootCmd.Flags().Duration("debugReadTimeout", 10*time.Second, "Time the debug server allows to read a whole request.")
+	RootCmd.Flags().Duration("debugWriteTimeout", 30*time.Second, "Time the debug server allows to write a response.")
+	RootCmd.Flags().Duration("debugIdleTimeout", 60*time.Second, "Time the debug server keeps an idle keep-alive connection open.")
 	RootCmd.Flags().String("logLevel", "info", "log level")
 	RootCmd.Flags().String("logFormat", "json", "line or json")
+	RootCmd.Flags().String("logDestination", "stderr", "stdout, stderr, syslog or file:/path. Log files are reopened on SIGHUP.")
+	RootCmd.Flags().String("auditLogFile", "", "File to append the decision audit log to, empty to disable.")
+	RootCmd.Flags().Bool("auditAllowed", false, "Also audit allowed decisions.")
+	RootCmd.Flags().String("auditFormat", "json", "Record format of the audit log and event sink, json, cef or leef.")
+	RootCmd.Flags().StringSlice("forensicCaptureRates", nil, "Fraction of blocks per reason code whose redacted headers are audited, e.g. METADATA=1,PRIVATE=0.01.")
+	RootCmd.Flags().String("eventSinkURL", "", "Broker to publish decision events to, e.g. nats://localhost:4222, empty to disable.")
+	RootCmd.Flags().String("eventSinkSubject", "extproc.decisions", "Subject decision events are published on.")
+	RootCmd.Flags().Int("eventSinkBuffer", 1024, "Number of events queued for the sink before new ones are dropped.")
+	RootCmd.Flags().Bool("eventSinkAllowed", false, "Also publish allowed decisions.")
+	RootCmd.Flags().Bool("probeDependencies", false, "Check at startup that dependencies such as the event sink are reachable.")
+	RootCmd.Flags().Duration("probeTimeout", 5*time.Second, "Timeout for each startup dependency probe.")
+	RootCmd.Flags().Bool("probeRequired", false, "Fail startup if a dependency probe fails.")
+	RootCmd.Flags().Bool("enableReflection", true, "Register the gRPC reflection service.")
+	RootCmd.Flags().Bool("enableHealthService", true, "Register the gRPC health service.")
+	RootCmd.Flags().Duration("startupGracePeriod", 0, "How long readiness reports NOT_SERVING after the listeners are up.")
+	RootCmd.Flags().Int64("maxRequests", 0, "Shut down cleanly after deciding this many requests, 0 for no limit.")
+	RootCmd.Flags().Bool("logRequestHeaders", false, "Log the request headers (redacted).")
+	RootCmd.Flags().Bool("traceIPChecks", false, "Log each IP safety check and its outcome at debug level.")
+	RootCmd.Flags().String("requestIDHeader", "x-request-id", "The header decisions are correlated by.")
+	RootCmd.Flags().Bool("generateRequestID", false, "Generate a request id for requests without one and add it to the request.")
+	RootCmd.Flags().String("mode", "heuristic", "IP policy mode, heuristic or allowlist-only.")
+	RootCmd.Flags().StringSlice("allowedCIDRs", nil, "Upstream CIDRs that are always allowed (comma-separated).")
+	RootCmd.Flags().StringSlice("deniedCIDRs", nil, "Upstream CIDRs that are always blocked (comma-separated).")
+	RootCmd.Flags().StringSlice("allowCIDR", nil, "Upstream CIDR that is always allowed, may be repeated. Added to allowedCIDRs.")
+	RootCmd.Flags().StringSlice("denyCIDR", nil, "Upstream CIDR that is always blocked, may be repeated. Added to deniedCIDRs.")
+	RootCmd.Flags().StringSlice("reservedRanges", nil, "Override blocking of named special-use ranges, e.g. cgnat=false,benchmarking=true.")
+	RootCmd.Flags().Bool("reverseLookup", false, "Also block upstreams whose reverse DNS names match deniedHosts.")
+	RootCmd.Flags().Duration("reverseLookupTimeout", 500*time.Millisecond, "Timeout for each reverse DNS lookup.")
+	RootCmd.Flags().Duration("reverseLookupCacheTTL", 5*time.Minute, "How long reverse DNS results are cached, regardless of the records' TTLs.")
+	RootCmd.Flags().Int("reverseLookupMaxInFlight", 0, "Deprecated, use maxConcurrentChecks.")
+	RootCmd.Flags().Int("maxConcurrentChecks", 0, "Maximum concurrent outbound checks such as reverse DNS queries across all streams, 0 for no limit. A decision that can't get a slot in time is blocked with a 503, or skips the check with failureMode open.")
+	RootCmd.Flags().Bool("reverseLookupFailClosed", false, "Block when a reverse DNS lookup fails.")
+	RootCmd.Flags().Bool("allowLoopback", false, "Allow loopback upstreams (local development only).")
+	RootCmd.Flags().String("policy", "", "YAML or JSON policy file overriding the CIDR lists, metadata service and block response settings, reloaded on change.")
+	RootCmd.Flags().Bool("allowMetadataService", false, "Allow the cloud metadata service addresses, for environments that proxy it through a hardened endpoint.")
+	RootCmd.Flags().StringSlice("attributeSources", nil, "Ordered namespace:path attribute sources for the upstream address, tried before attributeNamespaces.")
+	RootCmd.Flags().StringSlice("attributeNamespaces", nil, "Envoy attribute namespaces to search for the upstream address, in order. envoy.filters.http.ext_proc is always searched last.")
+	RootCmd.Flags().String("attributePath", "upstream.address", "Dotted field path of the upstream address within an attribute namespace.")
+	RootCmd.Flags().Bool("allowMissingAttributes", false, "Allow requests without any ext_proc attributes (logs a warning).")
+	RootCmd.Flags().String("failureMode", "closed", "Handling of requests whose upstream address can't be extracted, closed blocks and open continues with a warning.")
+	RootCmd.Flags().String("invalidAddress", "block", "Handling of upstream addresses that don't parse, block, allow or log.")
+	RootCmd.Flags().Bool("checkForwardedFor", false, "Also block if any x-forwarded-for hop is unsafe.")
+	RootCmd.Flags().String("forwardedForMalformed", "block", "Handling of malformed x-forwarded-for hops, block or skip.")
+	RootCmd.Flags().Int("blockStatusCode", 403, "HTTP status of block responses that don't have a specific one.")
+	RootCmd.Flags().String("blockBody", "", "Body template of block responses (Go text/template with .UpstreamIP, .Reason, .ReasonCode, .MatchedRule, .RequestID, .StatusCode and a json function to quote values in JSON bodies), empty to send a generic message.")
+	RootCmd.Flags().String("blockFormat", "text", "Block response body format, text or problem+json (RFC 7807).")
+	RootCmd.Flags().StringSlice("blockHeaders", nil, "Headers added to block responses, as name=value.")
+	RootCmd.Flags().String("blockContentType", "text/plain", "Content type of block response bodies.")
+	RootCmd.Flags().Uint32("blockGrpcStatus", 0, "gRPC status code set on block responses (0-16), unset by default.")
+	RootCmd.Flags().Int("maxRequestHeaders", 0, "Maximum number of request headers, 0 for no limit.")
+	RootCmd.Flags().Int("maxHeaderBytes", 0, "Maximum total size of request headers in bytes, 0 for no limit.")
+	RootCmd.Flags().Int("maxBodyChunks", 0, "Maximum body chunks per direction without end of stream, 0 for no limit.")
+	RootCmd.Flags().String("bodyChunksExceeded", "block", "Handling of streams over maxBodyChunks, block, allow or log.")
+	RootCmd.Flags().String("geoIPDB", "", "MaxMind format country/ASN database for deniedCountries and deniedASNs, reopened on SIGHUP.")
+	RootCmd.Flags().StringSlice("deniedCountries", nil, "ISO country codes whose upstreams are blocked, needs geoIPDB.")
+	RootCmd.Flags().StringSlice("deniedASNs", nil, "Autonomous system numbers whose upstreams are blocked, needs geoIPDB.")
+	RootCmd.Flags().StringSlice("deniedClusters", nil, "Upstream clusters that are always blocked.")
+	RootCmd.Flags().StringSlice("allowedClusters", nil, "Upstream clusters that are allowed without the IP checks.")
+	RootCmd.Flags().StringSlice("deniedContentTypes", nil, "Request content types that are blocked.")
+	RootCmd.Flags().StringSlice("allowedContentTypes", nil, "Request content types that are allowed, all others are blocked. Empty allows all.")
+	RootCmd.Flags().String("missingContentType", "allow", "Handling of requests without a content type when content types are restricted, allow or block.")
+	RootCmd.Flags().StringSlice("allowedMethods", nil, "Request methods that are allowed, e.g. GET,HEAD. Empty allows all.")
+	RootCmd.Flags().StringSlice("deniedHosts", nil, "Upstream host patterns that are always blocked, e.g. *.svc.cluster.local.")
+	RootCmd.Flags().Bool("enforceAuthoritySNIMatch", false, "Block requests whose :authority differs from the TLS SNI, when Envoy sends connection.requested_server_name.")
+	RootCmd.Flags().String("trustedValidationHeader", "", "Header carrying an upstream marker signed by an earlier hop, empty to disable.")
+	RootCmd.Flags().String("trustedValidationSecret", "", "HMAC secret for trustedValidationHeader, prefer EXTPROC_TRUSTEDVALIDATION_SECRET.")
+	RootCmd.Flags().String("bypassHeader", "", "Header carrying a signed token that downgrades a request to dry-run, empty to disable.")
+	RootCmd.Flags().String("bypassSecret", "", "HMAC secret for bypassHeader, prefer EXTPROC_BYPASS_SECRET.")
+	RootCmd.Flags().Bool("continueAndReplace", false, "Answer header phases with header mutations with CONTINUE_AND_REPLACE.")
+	RootCmd.Flags().Bool("debugDecisionHeader", false, "Add an x-extproc-decision header with the verdict (troubleshooting only).")
+	RootCmd.Flags().String("responseVerdictHeader", "", "A header set on the upstream response to the request's reason code and matched rule.")
+	RootCmd.Flags().Bool("echoRequestID", false, "Also set the request id on the upstream response.")
+	RootCmd.Flags().String("metadataNamespace", "", "Namespace for the emitted dynamic metadata, empty for top level.")
+	RootCmd.Flags().Duration("decisionTimeout", 0, "Deadline for a decision, 0 for none.")
+	RootCmd.Flags().String("timeoutHeader", "x-extproc-timeout-ms", "Request header with a per-request decision timeout in milliseconds, empty to disable.")
+	RootCmd.Flags().Duration("maxDecisionTimeout", 10*time.Second, "Maximum decision timeout accepted from the timeout header.")
+	RootCmd.Flags().StringSlice("responseRemoveHeaders", nil, "Headers stripped from upstream responses.")
+	RootCmd.Flags().StringSlice("responseDeniedContentTypes", nil, "Upstream response content types that are blocked.")
+	RootCmd.Flags().StringSlice("responseStatusRules", nil, "Upstream response status rules, first match wins, e.g. 500-599=block,404=add-header:x-upstream-missing=1. Actions are continue, add-header and block.")
+	RootCmd.Flags().Float64("logSampleRate", 1, "Fraction of allowed decisions logged (0.0-1.0), blocks are always logged.")
+	RootCmd.Flags().StringSlice("redactHeaders", []string{"authorization", "cookie", "x-api-key"}, "Headers whose values are redacted when logged.")
 
 	bindOrPanic("port", RootCmd.Flags().Lookup("port"))
+	bindOrPanic("bindAddress", RootCmd.Flags().Lookup("bindAddress"))
+	bindOrPanic("network", RootCmd.Flags().Lookup("network"))
+	bindOrPanic("listen", RootCmd.Flags().Lookup("listen"))
+	bindOrPanic("socketMode", RootCmd.Flags().Lookup("socketMode"))
+	bindOrPanic("tls.cert", RootCmd.Flags().Lookup("tlsCert"))
+	bindOrPanic("tls.key", RootCmd.Flags().Lookup("tlsKey"))
+	bindOrPanic("tls.ca", RootCmd.Flags().Lookup("tlsCA"))
+	bindOrPanic("tls.allowedSPIFFEIDs", RootCmd.Flags().Lookup("tlsAllowedSPIFFEIDs"))
+	bindOrPanic("tls.allowedDNSNames", RootCmd.Flags().Lookup("tlsAllowedDNSNames"))
+	bindOrPanic("tls.minVersion", RootCmd.Flags().Lookup("tlsMinVersion"))
+	bindOrPanic("tls.cipherSuites", RootCmd.Flags().Lookup("tlsCipherSuites"))
+	bindOrPanic("dualStack", RootCmd.Flags().Lookup("dualStack"))
+	bindOrPanic("reusePort", RootCmd.Flags().Lookup("reusePort"))
+	bindOrPanic("limits.maxStreams", RootCmd.Flags().Lookup("maxStreams"))
+	bindOrPanic("overload.response", RootCmd.Flags().Lookup("overloadResponse"))
+	bindOrPanic("overload.statusCode", RootCmd.Flags().Lookup("overloadStatusCode"))
+	bindOrPanic("overload.retryAfter", RootCmd.Flags().Lookup("overloadRetryAfter"))
+	bindOrPanic("limits.perStreamMsgRate", RootCmd.Flags().Lookup("perStreamMsgRate"))
+	bindOrPanic("workerPoolSize", RootCmd.Flags().Lookup("workerPoolSize"))
+	bindOrPanic("debug.port", RootCmd.Flags().Lookup("debugPort"))
+	bindOrPanic("debug.recentBlocks", RootCmd.Flags().Lookup("recentBlocks"))
+	bindOrPanic("debug.readHeaderTimeout", RootCmd.Flags().Lookup("debugReadHeaderTimeout"))
+	bindOrPanic("debug.readTimeout", RootCmd.Flags().Lookup("debugReadTimeout"))
+	bindOrPanic("debug.writeTimeout", RootCmd.Flags().Lookup("debugWriteTimeout"))
+	bindOrPanic("debug.idleTimeout", RootCmd.Flags().Lookup("debugIdleTimeout"))
 	bindOrPanic("log.level", RootCmd.Flags().Lookup("logLevel"))
 	bindOrPanic("log.format", RootCmd.Flags().Lookup("logFormat"))
+	bindOrPanic("log.destination", RootCmd.Flags().Lookup("logDestination"))
+	bindOrPanic("audit.file", RootCmd.Flags().Lookup("auditLogFile"))
+	bindOrPanic("audit.allowed", RootCmd.Flags().Lookup("auditAllowed"))
+	bindOrPanic("audit.format", RootCmd.Flags().Lookup("auditFormat"))
+	bindOrPanic("audit.forensicCaptureRates", RootCmd.Flags().Lookup("forensicCaptureRates"))
+	bindOrPanic("events.url", RootCmd.Flags().Lookup("eventSinkURL"))
+	bindOrPanic("events.subject", RootCmd.Flags().Lookup("eventSinkSubject"))
+	bindOrPanic("events.buffer", RootCmd.Flags().Lookup("eventSinkBuffer"))
+	bindOrPanic("events.allowed", RootCmd.Flags().Lookup("eventSinkAllowed"))
+	bindOrPanic("probe.enabled", RootCmd.Flags().Lookup("probeDependencies"))
+	bindOrPanic("probe.timeout", RootCmd.Flags().Lookup("probeTimeout"))
+	bindOrPanic("probe.required", RootCmd.Flags().Lookup("probeRequired"))
+	bindOrPanic("grpc.reflection", RootCmd.Flags().Lookup("enableReflection"))
+	bindOrPanic("grpc.health", RootCmd.Flags().Lookup("enableHealthService"))
+	bindOrPanic("grpc.startupGracePeriod", RootCmd.Flags().Lookup("startupGracePeriod"))
+	bindOrPanic("limits.maxRequests", RootCmd.Flags().Lookup("maxRequests"))
+	bindOrPanic("log.requestHeaders", RootCmd.Flags().Lookup("logRequestHeaders"))
+	bindOrPanic("log.traceIPChecks", RootCmd.Flags().Lookup("traceIPChecks"))
+	bindOrPanic("requestID.header", RootCmd.Flags().Lookup("requestIDHeader"))
+	bindOrPanic("requestID.generate", RootCmd.Flags().Lookup("generateRequestID"))
+	bindOrPanic("log.sampleRate", RootCmd.Flags().Lookup("logSampleRate"))
+	bindOrPanic("log.redactHeaders", RootCmd.Flags().Lookup("redactHeaders"))
+	bindOrPanic("mode", RootCmd.Flags().Lookup("mode"))
+	bindOrPanic("allowed.cidrs", RootCmd.Flags().Lookup("allowedCIDRs"))
+	bindOrPanic("denied.cidrs", RootCmd.Flags().Lookup("deniedCIDRs"))
+	bindOrPanic("allow.cidr", RootCmd.Flags().Lookup("allowCIDR"))
+	bindOrPanic("deny.cidr", RootCmd.Flags().Lookup("denyCIDR"))
+	bindOrPanic("reservedRanges", RootCmd.Flags().Lookup("reservedRanges"))
+	bindOrPanic("reverseLookup.enabled", RootCmd.Flags().Lookup("reverseLookup"))
+	bindOrPanic("reverseLookup.timeout", RootCmd.Flags().Lookup("reverseLookupTimeout"))
+	bindOrPanic("reverseLookup.cacheTTL", RootCmd.Flags().Lookup("reverseLookupCacheTTL"))
+	bindOrPanic("reverseLookup.maxInFlight", RootCmd.Flags().Lookup("reverseLookupMaxInFlight"))
+	bindOrPanic("checks.maxConcurrent", RootCmd.Flags().Lookup("maxConcurrentChecks"))
+	bindOrPanic("reverseLookup.failClosed", RootCmd.Flags().Lookup("reverseLookupFailClosed"))
+	bindOrPanic("allowLoopback", RootCmd.Flags().Lookup("allowLoopback"))
+	bindOrPanic("policy.file", RootCmd.Flags().Lookup("policy"))
+	bindOrPanic("allowMetadataService", RootCmd.Flags().Lookup("allowMetadataService"))
+	bindOrPanic("attributes.sources", RootCmd.Flags().Lookup("attributeSources"))
+	bindOrPanic("attributes.namespaces", RootCmd.Flags().Lookup("attributeNamespaces"))
+	bindOrPanic("attributes.path", RootCmd.Flags().Lookup("attributePath"))
+	bindOrPanic("allowMissingAttributes", RootCmd.Flags().Lookup("allowMissingAttributes"))
+	bindOrPanic("failureMode", RootCmd.Flags().Lookup("failureMode"))
+	bindOrPanic("invalidAddress", RootCmd.Flags().Lookup("invalidAddress"))
+	bindOrPanic("forwardedFor.check", RootCmd.Flags().Lookup("checkForwardedFor"))
+	bindOrPanic("forwardedFor.malformed", RootCmd.Flags().Lookup("forwardedForMalformed"))
+	bindOrPanic("block.statusCode", RootCmd.Flags().Lookup("blockStatusCode"))
+	bindOrPanic("block.body", RootCmd.Flags().Lookup("blockBody"))
+	bindOrPanic("block.format", RootCmd.Flags().Lookup("blockFormat"))
+	bindOrPanic("block.headers", RootCmd.Flags().Lookup("blockHeaders"))
+	bindOrPanic("block.contentType", RootCmd.Flags().Lookup("blockContentType"))
+	bindOrPanic("block.grpcStatus", RootCmd.Flags().Lookup("blockGrpcStatus"))
+	bindOrPanic("limits.maxRequestHeaders", RootCmd.Flags().Lookup("maxRequestHeaders"))
+	bindOrPanic("limits.maxHeaderBytes", RootCmd.Flags().Lookup("maxHeaderBytes"))
+	bindOrPanic("limits.maxBodyChunks", RootCmd.Flags().Lookup("maxBodyChunks"))
+	bindOrPanic("limits.bodyChunksExceeded", RootCmd.Flags().Lookup("bodyChunksExceeded"))
+	bindOrPanic("geoIP.db", RootCmd.Flags().Lookup("geoIPDB"))
+	bindOrPanic("denied.countries", RootCmd.Flags().Lookup("deniedCountries"))
+	bindOrPanic("denied.asns", RootCmd.Flags().Lookup("deniedASNs"))
+	bindOrPanic("denied.clusters", RootCmd.Flags().Lookup("deniedClusters"))
+	bindOrPanic("allowed.clusters", RootCmd.Flags().Lookup("allowedClusters"))
+	bindOrPanic("denied.contentTypes", RootCmd.Flags().Lookup("deniedContentTypes"))
+	bindOrPanic("allowed.contentTypes", RootCmd.Flags().Lookup("allowedContentTypes"))
+	bindOrPanic("missingContentType", RootCmd.Flags().Lookup("missingContentType"))
+	bindOrPanic("allowed.methods", RootCmd.Flags().Lookup("allowedMethods"))
+	bindOrPanic("denied.hosts", RootCmd.Flags().Lookup("deniedHosts"))
+	bindOrPanic("enforceAuthoritySNIMatch", RootCmd.Flags().Lookup("enforceAuthoritySNIMatch"))
+	bindOrPanic("debug.decisionHeader", RootCmd.Flags().Lookup("debugDecisionHeader"))
+	bindOrPanic("response.verdictHeader", RootCmd.Flags().Lookup("responseVerdictHeader"))
+	bindOrPanic("requestID.echo", RootCmd.Flags().Lookup("echoRequestID"))
+	bindOrPanic("trustedValidation.header", RootCmd.Flags().Lookup("trustedValidationHeader"))
+	bindOrPanic("trustedValidation.secret", RootCmd.Flags().Lookup("trustedValidationSecret"))
+	bindOrPanic("bypass.header", RootCmd.Flags().Lookup("bypassHeader"))
+	bindOrPanic("bypass.secret", RootCmd.Flags().Lookup("bypassSecret"))
+	bindOrPanic("continueAndReplace", RootCmd.Flags().Lookup("continueAndReplace"))
+	bindOrPanic("metadata.namespace", RootCmd.Flags().Lookup("metadataNamespace"))
+	bindOrPanic("decision.timeout", RootCmd.Flags().Lookup("decisionTimeout"))
+	bindOrPanic("decision.timeoutHeader", RootCmd.Flags().Lookup("timeoutHeader"))
+	bindOrPanic("decision.maxTimeout", RootCmd.Flags().Lookup("maxDecisionTimeout"))
+	bindOrPanic("response.removeHeaders", RootCmd.Flags().Lookup("responseRemoveHeaders"))
+	bindOrPanic("response.deniedContentTypes", RootCmd.Flags().Lookup("responseDeniedContentTypes"))
+	bindOrPanic("response.statusRules", RootCmd.Flags().Lookup("responseStatusRules"))
 }
 
 func initConfig() {
@@ -42,17 +257,276 @@ func bindOrPanic(key string, flag *flag.Flag) {
 }
 
 func run(cmd *cobra.Command, args []string) error {
-	logger, err := setupLogging(viper.GetString("log.level"), viper.GetString("log.format"))
+	logger, err := setupLogging(viper.GetString("log.level"), viper.GetString("log.format"), viper.GetString("log.destination"))
 	if err != nil {
 		return err
 	}
 
-	extproc.Init(logger, extprocConfig())
+	cfg, err := extprocConfig()
+	if err != nil {
+		return err
+	}
+	if err := extproc.Init(logger, cfg); err != nil {
+		return err
+	}
 	return extproc.Run()
 }
 
-func extprocConfig() *extproc.Config {
-	return &extproc.Config{
-		Port: viper.GetUint32("port"),
+func extprocConfig() (*extproc.Config, error) {
+	cfg := &extproc.Config{
+		Port:                     viper.GetUint32("port"),
+		BindAddress:              viper.GetString("bindAddress"),
+		Network:                  viper.GetString("network"),
+		Listen:                   viper.GetString("listen"),
+		TLSCert:                  viper.GetString("tls.cert"),
+		TLSKey:                   viper.GetString("tls.key"),
+		TLSCA:                    viper.GetString("tls.ca"),
+		TLSAllowedSPIFFEIDs:      getStringList("tls.allowedSPIFFEIDs"),
+		TLSAllowedDNSNames:       getStringList("tls.allowedDNSNames"),
+		TLSMinVersion:            viper.GetString("tls.minVersion"),
+		TLSCipherSuites:          getStringList("tls.cipherSuites"),
+		DualStack:                viper.GetBool("dualStack"),
+		ReusePort:                viper.GetBool("reusePort"),
+		MaxStreams:               viper.GetInt("limits.maxStreams"),
+		OverloadResponse:         viper.GetString("overload.response"),
+		OverloadStatusCode:       viper.GetInt("overload.statusCode"),
+		OverloadRetryAfter:       viper.GetString("overload.retryAfter"),
+		PerStreamMsgRate:         viper.GetFloat64("limits.perStreamMsgRate"),
+		WorkerPoolSize:           viper.GetInt("workerPoolSize"),
+		DebugPort:                viper.GetUint32("debug.port"),
+		RecentBlocksSize:         viper.GetInt("debug.recentBlocks"),
+		DebugReadHeaderTimeout:   viper.GetDuration("debug.readHeaderTimeout"),
+		DebugReadTimeout:         viper.GetDuration("debug.readTimeout"),
+		DebugWriteTimeout:        viper.GetDuration("debug.writeTimeout"),
+		DebugIdleTimeout:         viper.GetDuration("debug.idleTimeout"),
+		AuditLogFile:             viper.GetString("audit.file"),
+		AuditAllowed:             viper.GetBool("audit.allowed"),
+		AuditFormat:              viper.GetString("audit.format"),
+		EventSinkURL:             viper.GetString("events.url"),
+		EventSinkSubject:         viper.GetString("events.subject"),
+		EventSinkBuffer:          viper.GetInt("events.buffer"),
+		EventSinkAllowed:         viper.GetBool("events.allowed"),
+		ProbeDependenciesOnStart: viper.GetBool("probe.enabled"),
+		ProbeTimeout:             viper.GetDuration("probe.timeout"),
+		ProbeRequired:            viper.GetBool("probe.required"),
+		EnableReflection:         viper.GetBool("grpc.reflection"),
+		EnableHealthService:      viper.GetBool("grpc.health"),
+		StartupGracePeriod:       viper.GetDuration("grpc.startupGracePeriod"),
+		MaxRequests:              viper.GetInt64("limits.maxRequests"),
+		LogRequestHeaders:        viper.GetBool("log.requestHeaders"),
+		TraceIPChecks:            viper.GetBool("log.traceIPChecks"),
+		RequestIDHeader:          viper.GetString("requestID.header"),
+		GenerateRequestID:        viper.GetBool("requestID.generate"),
+		LogSampleRate:            viper.GetFloat64("log.sampleRate"),
+		RedactHeaders:            getStringList("log.redactHeaders"),
+		Mode:                     viper.GetString("mode"),
+		AllowedCIDRs:             append(getStringList("allowed.cidrs"), getStringList("allow.cidr")...),
+		DeniedCIDRs:              append(getStringList("denied.cidrs"), getStringList("deny.cidr")...),
+		MaxRequestHeaders:        viper.GetInt("limits.maxRequestHeaders"),
+		MaxHeaderBytes:           viper.GetInt("limits.maxHeaderBytes"),
+		MaxBodyChunks:            viper.GetInt("limits.maxBodyChunks"),
+		BodyChunksExceeded:       viper.GetString("limits.bodyChunksExceeded"),
+		GeoIPDBPath:              viper.GetString("geoIP.db"),
+		DeniedCountries:          getStringList("denied.countries"),
+		DeniedClusters:           getStringList("denied.clusters"),
+		AllowedClusters:          getStringList("allowed.clusters"),
+		DeniedContentTypes:       getStringList("denied.contentTypes"),
+		AllowedContentTypes:      getStringList("allowed.contentTypes"),
+		MissingContentType:       viper.GetString("missingContentType"),
+		AllowedMethods:           getStringList("allowed.methods"),
+		DeniedHosts:              getStringList("denied.hosts"),
+		EnforceAuthoritySNIMatch: viper.GetBool("enforceAuthoritySNIMatch"),
+		ReverseLookup:            viper.GetBool("reverseLookup.enabled"),
+		ReverseLookupTimeout:     viper.GetDuration("reverseLookup.timeout"),
+		ReverseLookupCacheTTL:    viper.GetDuration("reverseLookup.cacheTTL"),
+		ReverseLookupMaxInFlight: viper.GetInt("reverseLookup.maxInFlight"),
+		MaxConcurrentChecks:      viper.GetInt("checks.maxConcurrent"),
+		AllowLoopback:            viper.GetBool("allowLoopback"),
+		AllowMetadataService:     viper.GetBool("allowMetadataService"),
+		PolicyFile:               viper.GetString("policy.file"),
+		AttributeNamespaces:      getStringList("attributes.namespaces"),
+		AttributePath:            viper.GetString("attributes.path"),
+		AllowMissingAttributes:   viper.GetBool("allowMissingAttributes"),
+		FailureMode:              viper.GetString("failureMode"),
+		InvalidAddress:           viper.GetString("invalidAddress"),
+		CheckForwardedFor:        viper.GetBool("forwardedFor.check"),
+		ForwardedForMalformed:    viper.GetString("forwardedFor.malformed"),
+		BlockStatusCode:          viper.GetInt("block.statusCode"),
+		BlockBody:                viper.GetString("block.body"),
+		BlockFormat:              viper.GetString("block.format"),
+		BlockContentType:         viper.GetString("block.contentType"),
+		DebugDecisionHeader:      viper.GetBool("debug.decisionHeader"),
+		ResponseVerdictHeader:    viper.GetString("response.verdictHeader"),
+		EchoRequestID:            viper.GetBool("requestID.echo"),
+		ContinueAndReplace:       viper.GetBool("continueAndReplace"),
+		TrustedValidationHeader:  viper.GetString("trustedValidation.header"),
+		TrustedValidationSecret:  extproc.Secret(viper.GetString("trustedValidation.secret")),
+		BypassHeader:             viper.GetString("bypass.header"),
+		BypassSecret:             extproc.Secret(viper.GetString("bypass.secret")),
+		MetadataNamespace:        viper.GetString("metadata.namespace"),
+		DecisionTimeout:          viper.GetDuration("decision.timeout"),
+		TimeoutHeader:            viper.GetString("decision.timeoutHeader"),
+		MaxDecisionTimeout:       viper.GetDuration("decision.maxTimeout"),
+
+		ReverseLookupFailClosed: viper.GetBool("reverseLookup.failClosed"),
+
+		ResponseRemoveHeaders:      getStringList("response.removeHeaders"),
+		ResponseDeniedContentTypes: getStringList("response.deniedContentTypes"),
+	}
+
+	if viper.IsSet("block.grpcStatus") {
+		grpcStatus := viper.GetUint32("block.grpcStatus")
+		cfg.BlockGrpcStatus = &grpcStatus
+	}
+
+	var err error
+	if cfg.SocketMode, err = getFileMode("socketMode"); err != nil {
+		return nil, err
+	}
+	if cfg.ForensicCaptureRates, err = getFloatMap("audit.forensicCaptureRates"); err != nil {
+		return nil, err
+	}
+	if cfg.ReservedRanges, err = getBoolMap("reservedRanges"); err != nil {
+		return nil, err
+	}
+	if cfg.BlockHeaders, err = getStringMap("block.headers"); err != nil {
+		return nil, err
+	}
+	if cfg.DeniedASNs, err = getUintList("denied.asns"); err != nil {
+		return nil, err
+	}
+	if cfg.ResponseStatusRules, err = getResponseStatusRules("response.statusRules"); err != nil {
+		return nil, err
+	}
+	if cfg.AttributeSources, err = getAttributeSources("attributes.sources"); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// getAttributeSources reads a list of namespace:path entries.
+func getAttributeSources(key string) ([]extproc.AttributeSource, error) {
+	var sources []extproc.AttributeSource
+	for _, entry := range getStringList(key) {
+		ns, path, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q, expected namespace:path", key, entry)
+		}
+		sources = append(sources, extproc.AttributeSource{Namespace: strings.TrimSpace(ns), Path: strings.TrimSpace(path)})
+	}
+	return sources, nil
+}
+
+// getResponseStatusRules reads a list of status[-status]=action entries, with
+// add-header taking the header as add-header:name=value.
+func getResponseStatusRules(key string) ([]extproc.ResponseStatusRule, error) {
+	var rules []extproc.ResponseStatusRule
+	for _, entry := range getStringList(key) {
+		statuses, action, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q, expected status[-status]=action", key, entry)
+		}
+		minStatus, maxStatus, isRange := strings.Cut(statuses, "-")
+		if !isRange {
+			maxStatus = minStatus
+		}
+		rule := extproc.ResponseStatusRule{Action: strings.TrimSpace(action)}
+		var err error
+		if rule.Min, err = strconv.Atoi(strings.TrimSpace(minStatus)); err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", key, entry, err)
+		}
+		if rule.Max, err = strconv.Atoi(strings.TrimSpace(maxStatus)); err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", key, entry, err)
+		}
+		if action, header, ok := strings.Cut(rule.Action, ":"); ok {
+			rule.Action = action
+			rule.HeaderName, rule.HeaderValue, _ = strings.Cut(header, "=")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// getFileMode reads an octal permission setting such as 0660.
+func getFileMode(key string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(viper.GetString(key), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q, expected octal permissions", key, viper.GetString(key))
+	}
+	return os.FileMode(mode), nil
+}
+
+// getStringMap reads a list setting of name=value entries.
+func getStringMap(key string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, entry := range getStringList(key) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q, expected name=value", key, entry)
+		}
+		m[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return m, nil
+}
+
+// getBoolMap reads a list of name=bool entries.
+func getBoolMap(key string) (map[string]bool, error) {
+	m := map[string]bool{}
+	for _, entry := range getStringList(key) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q, expected name=true|false", key, entry)
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", key, entry, err)
+		}
+		m[strings.TrimSpace(name)] = b
+	}
+	return m, nil
+}
+
+// getFloatMap reads a list setting of name=number entries.
+func getFloatMap(key string) (map[string]float64, error) {
+	m := map[string]float64{}
+	for _, entry := range getStringList(key) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q, expected name=number", key, entry)
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", key, entry, err)
+		}
+		m[strings.TrimSpace(name)] = f
+	}
+	return m, nil
+}
+
+// getUintList reads a list setting of unsigned integers.
+func getUintList(key string) ([]uint, error) {
+	var list []uint
+	for _, entry := range getStringList(key) {
+		n, err := strconv.ParseUint(entry, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", key, entry, err)
+		}
+		list = append(list, uint(n))
+	}
+	return list, nil
+}
+
+// getStringList reads a list setting. Values arriving from env vars are a
+// single string, so entries are also split on commas and trimmed.
+func getStringList(key string) []string {
+	var list []string
+	for _, value := range viper.GetStringSlice(key) {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				list = append(list, entry)
+			}
+		}
 	}
+	return list
 }
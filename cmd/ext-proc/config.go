@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	extproc "github.com/bladedancer/envoy-ext-proc/pkg/ext-proc"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the resolved configuration.",
+}
+
+var configDumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Print the configuration resolved from flags and environment without starting the server.",
+	RunE:  configDump,
+}
+
+func init() {
+	// Share the server flags so they resolve exactly as they would for a run.
+	configDumpCmd.Flags().AddFlagSet(RootCmd.Flags())
+	configDumpCmd.Flags().String("output", "yaml", "Output format, yaml or json.")
+
+	configCmd.AddCommand(configDumpCmd)
+	RootCmd.AddCommand(configCmd)
+}
+
+func configDump(cmd *cobra.Command, args []string) error {
+	cfg, err := extprocConfig()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	settings := configSettings(cfg.Redacted())
+
+	var out []byte
+	switch format, _ := cmd.Flags().GetString("output"); format {
+	case "yaml":
+		out, err = yaml.Marshal(settings)
+	case "json":
+		out, err = json.MarshalIndent(settings, "", "  ")
+		out = append(out, '\n')
+	default:
+		return fmt.Errorf("invalid output format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = cmd.OutOrStdout().Write(out)
+	return err
+}
+
+// configSettings flattens the resolved config for printing, keyed by field
+// name: durations as strings, file modes in octal and secrets redacted.
+// Hooks that can only be set from code, such as Deciders, are left out.
+func configSettings(cfg *extproc.Config) map[string]interface{} {
+	v := reflect.ValueOf(cfg).Elem()
+	out := make(map[string]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() || isHook(field.Type) {
+			continue
+		}
+		out[field.Name] = settingValue(v.Field(i))
+	}
+	return out
+}
+
+// isHook reports whether a Config field holds code rather than settings.
+func isHook(t reflect.Type) bool {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Interface || t.Kind() == reflect.Func
+}
+
+func settingValue(v reflect.Value) interface{} {
+	switch val := v.Interface().(type) {
+	case time.Duration:
+		return val.String()
+	case os.FileMode:
+		return fmt.Sprintf("%#o", uint32(val))
+	case extproc.Secret:
+		return val.String()
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		return settingValue(v.Elem())
+	}
+	return v.Interface()
+}
@@ -2,6 +2,13 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -11,6 +18,11 @@ const (
 	lineFormat = "line"
 	jsonFormat = "json"
 	logPackage = "package"
+
+	stdoutDestination = "stdout"
+	stderrDestination = "stderr"
+	syslogDestination = "syslog"
+	fileDestination   = "file:"
 )
 
 var log logrus.FieldLogger = logrus.StandardLogger()
@@ -27,7 +39,7 @@ func getFormatter(format string) (logrus.Formatter, error) {
 }
 
 // setupLogging sets up the logger
-func setupLogging(level string, format string) (*logrus.Logger, error) {
+func setupLogging(level string, format string, destination string) (*logrus.Logger, error) {
 	lvl, err := logrus.ParseLevel(level)
 	if err != nil {
 		return nil, err
@@ -42,7 +54,96 @@ func setupLogging(level string, format string) (*logrus.Logger, error) {
 	logger := logrus.New()
 	logger.Level = lvl
 	logger.Formatter = formatter
+	if err := setLogDestination(logger, destination); err != nil {
+		return nil, err
+	}
 	log = logger.WithField(logPackage, "cmd")
 
 	return logger, nil
-}
\ No newline at end of file
+}
+
+// setLogDestination points the logger at stdout, stderr, syslog or
+// file:/path. Log files are reopened on SIGHUP for rotation.
+func setLogDestination(logger *logrus.Logger, destination string) error {
+	switch {
+	case destination == "" || destination == stderrDestination:
+		logger.Out = os.Stderr
+	case destination == stdoutDestination:
+		logger.Out = os.Stdout
+	case destination == syslogDestination:
+		hook, err := newSyslogHook()
+		if err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+		logger.AddHook(hook)
+		logger.Out = io.Discard
+	case strings.HasPrefix(destination, fileDestination):
+		f, err := openLogFile(strings.TrimPrefix(destination, fileDestination))
+		if err != nil {
+			return err
+		}
+		logger.Out = f
+	default:
+		return fmt.Errorf("invalid log destination %q", destination)
+	}
+	return nil
+}
+
+// logFile is a log file that is reopened on SIGHUP.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	if path == "" {
+		return nil, errors.New("log file path is empty")
+	}
+	l := &logFile{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			l.reopen()
+		}
+	}()
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	return nil
+}
+
+// reopen closes the file and opens the path again, so a rotated file is
+// replaced by a new one.
+func (l *logFile) reopen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+	if err := l.open(); err != nil {
+		// Nowhere better to report it.
+		fmt.Fprintf(os.Stderr, "log file reopen error %v\n", err)
+		l.file = nil
+	}
+}
+
+// Write implements io.Writer. Lines are dropped while the file can't be
+// reopened.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return len(p), nil
+	}
+	return l.file.Write(p)
+}
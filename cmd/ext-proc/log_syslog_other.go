@@ -0,0 +1,13 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newSyslogHook() (logrus.Hook, error) {
+	return nil, errors.New("not supported on this platform")
+}
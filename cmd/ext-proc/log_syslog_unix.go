@@ -0,0 +1,15 @@
+//go:build unix
+
+package cmd
+
+import (
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// newSyslogHook sends log entries to the local syslog at their own severity.
+func newSyslogHook() (logrus.Hook, error) {
+	return lsyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, "extprocdemo")
+}
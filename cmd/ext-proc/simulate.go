@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	extproc "github.com/bladedancer/envoy-ext-proc/pkg/ext-proc"
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Print the response and decision for a captured ProcessingRequest without starting the server.",
+	RunE:  simulate,
+}
+
+func init() {
+	// Share the server flags so the policy matches a run with the same flags.
+	simulateCmd.Flags().AddFlagSet(RootCmd.Flags())
+	simulateCmd.Flags().String("request", "-", "File holding the ProcessingRequest as protojson, - for stdin.")
+
+	RootCmd.AddCommand(simulateCmd)
+}
+
+// simulation is the simulate output.
+type simulation struct {
+	Response json.RawMessage  `json:"response"`
+	Decision extproc.Decision `json:"decision"`
+}
+
+func simulate(cmd *cobra.Command, args []string) error {
+	path, _ := cmd.Flags().GetString("request")
+	data, err := readRequest(cmd, path)
+	if err != nil {
+		return err
+	}
+	req := &extProcPb.ProcessingRequest{}
+	if err := protojson.Unmarshal(data, req); err != nil {
+		return fmt.Errorf("invalid request %s: %w", path, err)
+	}
+
+	cfg, err := extprocConfig()
+	if err != nil {
+		return err
+	}
+	resp, decision, err := extproc.Simulate(cfg, req)
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		return fmt.Errorf("no response for request %s", path)
+	}
+	out := simulation{Decision: decision}
+	if out.Response, err = protojson.Marshal(resp); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(cmd.OutOrStdout())
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func readRequest(cmd *cobra.Command, path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(cmd.InOrStdin())
+	}
+	return os.ReadFile(path)
+}
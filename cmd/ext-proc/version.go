@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// Build metadata, injected with -ldflags "-X ...". See the Makefile.
+var (
+	Version   = "dev"
+	GitCommit = "dev"
+	BuildDate = "dev"
+)
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print build metadata.",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Fprint(cmd.OutOrStdout(), cmd.Root().Name()+" "+versionInfo())
+	},
+}
+
+func init() {
+	RootCmd.Version = Version
+	RootCmd.SetVersionTemplate("{{ .Name }} " + versionInfo())
+	RootCmd.AddCommand(versionCmd)
+}
+
+func versionInfo() string {
+	return fmt.Sprintf("version %s\n  commit:     %s\n  built:      %s\n  go version: %s\n  platform:   %s/%s\n",
+		Version, GitCommit, BuildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
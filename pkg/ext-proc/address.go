@@ -0,0 +1,200 @@
+package extproc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// normalizeAddress parses an Envoy address attribute ("ip", "ip:port",
+// "[ipv6]" or "[ipv6]:port", optionally with a zone) into an IP and port. IPv4-mapped IPv6 addresses
+// are reduced to their 4-byte form and legacy IPv4 encodings are decoded so
+// every check sees one representation.
+// The port is 0 when the attribute doesn't carry one.
+func normalizeAddress(addr string) (net.IP, int, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return nil, 0, ErrExtraction
+	}
+
+	host, port := addr, 0
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: invalid port %q", ErrInvalidAddress, p)
+		}
+		host, port = h, int(n)
+	} else if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		host = addr[1 : len(addr)-1]
+	}
+
+	// Drop an IPv6 zone identifier (fe80::1%eth0), net.ParseIP rejects it and
+	// the zone has no bearing on which range the address belongs to.
+	if i := strings.IndexByte(host, '%'); i >= 0 && strings.Contains(host[:i], ":") {
+		host = host[:i]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = parseLegacyIPv4(host)
+	}
+	if ip == nil {
+		return nil, 0, ErrInvalidAddress
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, port, nil
+}
+
+// parseLegacyIPv4 decodes the inet_aton forms net.ParseIP rejects, which are
+// common in SSRF payloads because many resolvers and HTTP clients accept them:
+// a single integer (2130706433, 0x7f000001), octal or hex parts (0177.0.0.1)
+// and short forms where the last part fills the remaining bytes (127.1). It
+// returns nil for anything else.
+func parseLegacyIPv4(host string) net.IP {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+
+	var n uint64
+	for i, part := range parts {
+		v, ok := parseLegacyIPv4Part(part)
+		if !ok {
+			return nil
+		}
+		// Each leading part is a byte, the last one fills what's left.
+		bits := 8
+		if i == len(parts)-1 {
+			bits = 8 * (4 - i)
+		}
+		if v >= 1<<bits {
+			return nil
+		}
+		n = n<<bits | v
+	}
+	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).To4()
+}
+
+// parseLegacyIPv4Part parses one part of a legacy IPv4 address: hex with a
+// 0x prefix, octal with a leading 0, decimal otherwise.
+func parseLegacyIPv4Part(part string) (uint64, bool) {
+	base := 10
+	switch {
+	case len(part) > 2 && (part[:2] == "0x" || part[:2] == "0X"):
+		base, part = 16, part[2:]
+	case len(part) > 1 && part[0] == '0':
+		base, part = 8, part[1:]
+	}
+	v, err := strconv.ParseUint(part, base, 32)
+	return v, err == nil
+}
+
+// extProcAttributes is the attribute namespace Envoy uses for ext_proc. It
+// is always searched last as a fallback.
+const extProcAttributes = "envoy.filters.http.ext_proc"
+
+// defaultAttributePath is the field holding the upstream address.
+const defaultAttributePath = "upstream.address"
+
+// attributeSources returns the attribute sources to search, in order.
+func attributeSources(cfg *Config) []AttributeSource {
+	if cfg == nil || cfg.compiled == nil {
+		return []AttributeSource{{Namespace: extProcAttributes, Path: defaultAttributePath}}
+	}
+	return cfg.compiled.attributeSources
+}
+
+// hasFilterAttributes reports whether Envoy attached any of the configured
+// attribute structs at all. Their absence usually means request_attributes
+// isn't configured on the filter.
+func hasFilterAttributes(cfg *Config, attributes map[string]*structpb.Struct) bool {
+	for _, src := range attributeSources(cfg) {
+		if _, ok := attributes[src.Namespace]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// extractUpstreamAddress extracts the raw upstream address from request
+// attributes along with the source it came from. The first source holding a
+// parseable IP wins. If none does, the first non-empty value is returned so
+// it's reported as an invalid address.
+func extractUpstreamAddress(cfg *Config, attributes map[string]*structpb.Struct) (string, string) {
+	if attributes == nil {
+		return "", ""
+	}
+
+	var raw, rawSource string
+	for _, src := range attributeSources(cfg) {
+		v := lookupAttribute(attributes[src.Namespace], src.Path)
+		if v == nil || v.GetStringValue() == "" {
+			continue
+		}
+		addr := v.GetStringValue()
+		if _, _, err := normalizeAddress(addr); err == nil {
+			return addr, src.String()
+		}
+		if raw == "" {
+			raw, rawSource = addr, src.String()
+		}
+	}
+	return raw, rawSource
+}
+
+// clusterAttributePath is the field holding the upstream cluster name.
+const clusterAttributePath = "xds.cluster_name"
+
+// extractUpstreamCluster returns the upstream cluster name from the first
+// attribute namespace that carries one, or "".
+func extractUpstreamCluster(cfg *Config, attributes map[string]*structpb.Struct) string {
+	for _, src := range attributeSources(cfg) {
+		if name := lookupAttribute(attributes[src.Namespace], clusterAttributePath).GetStringValue(); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// sniAttributePath is the field holding the TLS SNI Envoy saw.
+const sniAttributePath = "connection.requested_server_name"
+
+// extractSNI returns the TLS server name from the first attribute namespace
+// that carries one, or "" for plaintext connections and when Envoy doesn't
+// send it.
+func extractSNI(cfg *Config, attributes map[string]*structpb.Struct) string {
+	for _, src := range attributeSources(cfg) {
+		if name := lookupAttribute(attributes[src.Namespace], sniAttributePath).GetStringValue(); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// lookupAttribute resolves a dotted path in s. Envoy usually sends attributes
+// as flat keys ("upstream.address") so the full key is tried first, then each
+// leading segment is descended into as a nested struct.
+func lookupAttribute(s *structpb.Struct, path string) *structpb.Value {
+	if s == nil || s.Fields == nil {
+		return nil
+	}
+	if v, ok := s.Fields[path]; ok && v != nil {
+		return v
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+		if v, ok := s.Fields[path[:i]]; ok {
+			if found := lookupAttribute(v.GetStructValue(), path[i+1:]); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
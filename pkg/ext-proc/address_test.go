@@ -0,0 +1,235 @@
+package extproc
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue returns the current value of c.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// garbageAddresses are upstream address attributes that are present but
+// don't parse.
+var garbageAddresses = []string{
+	"not-an-ip",
+	"999.1.1.1",
+	"1.2.3.4.5",
+	"[::1",
+	"::g",
+	"1.2.3.4:abc",
+	"1.2.3.4:70000",
+	"0x1ffffffff",
+	"[]:80",
+	"%",
+}
+
+func TestNormalizeAddressLegacyIPv4(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+		code ReasonCode
+	}{
+		// A single 32-bit integer
+		{"2130706433", "127.0.0.1", ReasonLoopback},
+		{"2130706433:8080", "127.0.0.1", ReasonLoopback},
+		{"0x7f000001", "127.0.0.1", ReasonLoopback},
+		{"0X7F000001", "127.0.0.1", ReasonLoopback},
+		{"017700000001", "127.0.0.1", ReasonLoopback},
+		{"2852039166", "169.254.169.254", ReasonLinkLocal},
+		{"0xa9fea9fe:80", "169.254.169.254", ReasonLinkLocal},
+		{"1572395042", "93.184.216.34", ReasonAllowed},
+		// Octal and hex parts
+		{"0177.0.0.1", "127.0.0.1", ReasonLoopback},
+		{"0x7f.0x0.0x0.0x1", "127.0.0.1", ReasonLoopback},
+		{"012.0.0.01", "10.0.0.1", ReasonPrivate},
+		{"0xa9.0376.169.0xfe", "169.254.169.254", ReasonLinkLocal},
+		{"0300.0250.1.1:443", "192.168.1.1", ReasonPrivate},
+		// Short forms, the last part fills the remaining bytes
+		{"127.1", "127.0.0.1", ReasonLoopback},
+		{"10.1", "10.0.0.1", ReasonPrivate},
+		{"192.168.257", "192.168.1.1", ReasonPrivate},
+		{"169.0xfea9fe", "169.254.169.254", ReasonLinkLocal},
+		{"0", "0.0.0.0", ReasonUnspecified},
+	}
+	for _, tt := range tests {
+		ip, _, err := normalizeAddress(tt.addr)
+		if err != nil || !ip.Equal(net.ParseIP(tt.want)) || len(ip) != net.IPv4len {
+			t.Errorf("normalizeAddress(%q) = %v, %v, want %s", tt.addr, []byte(ip), err, tt.want)
+			continue
+		}
+		if d := Evaluate(&Config{}, requestHeaders(tt.addr)); d.ReasonCode != tt.code {
+			t.Errorf("Evaluate(%s) = %s, want %s", tt.addr, d.ReasonCode, tt.code)
+		}
+	}
+
+	// Parts that overflow their bytes, or aren't numbers in their base
+	for _, addr := range []string{"4294967296", "0x100000000", "256.1", "1.256.1.1", "1.2.3.256", "1.2.65536", "08.0.0.1", "0x.1", "0xg.0.0.1", "1..1", "1.2.3.4."} {
+		if ip, _, err := normalizeAddress(addr); err == nil {
+			t.Errorf("normalizeAddress(%q) = %s, want an error", addr, ip)
+		}
+	}
+}
+
+func TestNormalizeAddressInvalid(t *testing.T) {
+	for _, addr := range garbageAddresses {
+		if ip, _, err := normalizeAddress(addr); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("normalizeAddress(%q) = %s, %v, want %v", addr, ip, err, ErrInvalidAddress)
+		}
+	}
+	for _, addr := range []string{"", " ", "\t\n"} {
+		if ip, _, err := normalizeAddress(addr); !errors.Is(err, ErrExtraction) {
+			t.Errorf("normalizeAddress(%q) = %s, %v, want %v", addr, ip, err, ErrExtraction)
+		}
+	}
+}
+
+func TestInvalidAddressHandling(t *testing.T) {
+	tests := []struct {
+		action    string
+		wantAllow bool
+		failOpen  bool
+	}{
+		{"", false, false},
+		{InvalidAddressBlock, false, false},
+		{InvalidAddressAllow, true, false},
+		{InvalidAddressLog, true, true},
+	}
+	for _, tt := range tests {
+		metricAction := tt.action
+		if metricAction == "" {
+			metricAction = InvalidAddressBlock
+		}
+		handled := invalidAddressTotal.WithLabelValues(metricAction)
+		warned := failOpenTotal.WithLabelValues(string(ReasonInvalidAddress))
+
+		for _, addr := range garbageAddresses {
+			before, warnedBefore := counterValue(t, handled), counterValue(t, warned)
+			d := Evaluate(&Config{InvalidAddress: tt.action}, requestHeaders(addr))
+			if d.Allow != tt.wantAllow || d.ReasonCode != ReasonInvalidAddress {
+				t.Errorf("InvalidAddress %q: Evaluate(%q) = %+v, want allow %v with %s", tt.action, addr, d, tt.wantAllow, ReasonInvalidAddress)
+			}
+			if got := counterValue(t, handled) - before; got != 1 {
+				t.Errorf("InvalidAddress %q: %q counted %v times, want 1", tt.action, addr, got)
+			}
+			if got := counterValue(t, warned) - warnedBefore; (got == 1) != tt.failOpen {
+				t.Errorf("InvalidAddress %q: %q fail-open warnings = %v, want %v", tt.action, addr, got, tt.failOpen)
+			}
+		}
+	}
+}
+
+// An empty attribute is a missing address, not a malformed one, so it
+// follows FailureMode whatever InvalidAddress says.
+func TestEmptyAddress(t *testing.T) {
+	for _, addr := range []string{"", "  "} {
+		for _, action := range []string{InvalidAddressBlock, InvalidAddressAllow, InvalidAddressLog} {
+			d := Evaluate(&Config{InvalidAddress: action}, requestHeaders(addr))
+			if d.Allow || d.ReasonCode != ReasonExtraction {
+				t.Errorf("InvalidAddress %q: Evaluate(%q) = %+v, want %s", action, addr, d, ReasonExtraction)
+			}
+		}
+		d := Evaluate(&Config{FailureMode: FailureModeOpen}, requestHeaders(addr))
+		if !d.Allow || d.ReasonCode != ReasonExtraction {
+			t.Errorf("FailureMode open: Evaluate(%q) = %+v, want allowed %s", addr, d, ReasonExtraction)
+		}
+	}
+}
+
+func TestNormalizeAddressZone(t *testing.T) {
+	tests := []struct {
+		addr     string
+		wantIP   string
+		wantPort int
+		want     ReasonCode
+	}{
+		{"fe80::1%eth0", "fe80::1", 0, ReasonLinkLocal},
+		{"[fe80::1%eth0]:8080", "fe80::1", 8080, ReasonLinkLocal},
+		{"[fe80::1%25eth0]:80", "fe80::1", 80, ReasonLinkLocal},
+		{"[::1%lo]:443", "::1", 443, ReasonLoopback},
+		{"[fd00::5%2]:443", "fd00::5", 443, ReasonPrivate},
+		{"2606:4700:4700::1111%eth0", "2606:4700:4700::1111", 0, ReasonAllowed},
+		{"[2606:4700:4700::1111%eth0]:443", "2606:4700:4700::1111", 443, ReasonAllowed},
+		{"[::ffff:10.0.0.1%eth0]:80", "10.0.0.1", 80, ReasonPrivate},
+	}
+	for _, tt := range tests {
+		ip, port, err := normalizeAddress(tt.addr)
+		if err != nil {
+			t.Errorf("normalizeAddress(%q) = %v", tt.addr, err)
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tt.wantIP)) || port != tt.wantPort {
+			t.Errorf("normalizeAddress(%q) = %s, %d, want %s, %d", tt.addr, ip, port, tt.wantIP, tt.wantPort)
+		}
+		if d := Evaluate(&Config{}, requestHeaders(tt.addr)); d.ReasonCode != tt.want {
+			t.Errorf("Evaluate(%s) = %s, want %s", tt.addr, d.ReasonCode, tt.want)
+		}
+	}
+
+	// A zone only belongs on an IPv6 address.
+	for _, addr := range []string{"10.0.0.1%eth0", "10.0.0.1%eth0:80", "%eth0"} {
+		if ip, _, err := normalizeAddress(addr); err == nil {
+			t.Errorf("normalizeAddress(%q) = %s, want an error", addr, ip)
+		}
+	}
+}
+
+func FuzzNormalizeAddress(f *testing.F) {
+	for _, seed := range []string{
+		"93.184.216.34:443",
+		"10.0.0.1:8080",
+		"[::1]:443",
+		"::ffff:127.0.0.1",
+		"[::ffff:a00:1]:80",
+		"fe80::1%eth0",
+		"[fe80::1%25eth0]:80",
+		"169.254.169.254",
+		"0x7f000001",
+		"2130706433",
+		"0177.0.0.1",
+		"127.1",
+		"",
+		":",
+		"[",
+		"[]:80",
+		"1.2.3.4:99999",
+		"%",
+	} {
+		f.Add(seed)
+	}
+	cfg := &Config{}
+	if err := cfg.Validate(); err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, addr string) {
+		ip, port, err := normalizeAddress(addr)
+		if err != nil {
+			if ip != nil {
+				t.Fatalf("normalizeAddress(%q) = %s with error %v", addr, ip, err)
+			}
+			return
+		}
+		if len(ip) != 4 && len(ip) != 16 {
+			t.Fatalf("normalizeAddress(%q) = %v, not a 4 or 16 byte IP", addr, []byte(ip))
+		}
+		if port < 0 || port > 65535 {
+			t.Fatalf("normalizeAddress(%q) port = %d", addr, port)
+		}
+		unsafe := ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+			ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast()
+		if d := isUpstreamIPSafe(cfg, ip); unsafe && d.Allow {
+			t.Fatalf("normalizeAddress(%q) = %s, which is allowed: %+v", addr, ip, d)
+		}
+	})
+}
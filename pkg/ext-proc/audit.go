@@ -0,0 +1,128 @@
+package extproc
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+)
+
+const auditFlushInterval = time.Second
+
+// Event is a decision record, written as one line of the audit log and sent
+// to the EventSink.
+type Event struct {
+	Time        time.Time  `json:"time"`
+	Allowed     bool       `json:"allowed"`
+	UpstreamIP  string     `json:"upstreamIp"`
+	ReasonCode  ReasonCode `json:"reasonCode"`
+	Reason      string     `json:"reason,omitempty"`
+	MatchedRule string     `json:"matchedRule,omitempty"`
+	RequestID   string     `json:"requestId,omitempty"`
+	Authority   string     `json:"authority,omitempty"`
+	// Headers are the redacted request headers, captured for a sample of
+	// blocks per Config.ForensicCaptureRates.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// auditLog appends JSON records to a file through a buffer that is flushed
+// periodically. It is safe for concurrent use, and a nil *auditLog discards
+// records.
+type auditLog struct {
+	mu     sync.Mutex
+	path   string
+	format string
+	file   *os.File
+	w      *bufio.Writer
+	stop   chan struct{}
+}
+
+func openAuditLog(path, format string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	a := &auditLog{path: path, format: format, stop: make(chan struct{})}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	go a.flushLoop()
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	a.w = bufio.NewWriter(f)
+	return nil
+}
+
+func (a *auditLog) flushLoop() {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.mu.Lock()
+			if err := a.w.Flush(); err != nil {
+				log.Errorf("audit log flush error %v", err)
+			}
+			a.mu.Unlock()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// write appends a record.
+func (a *auditLog) write(rec Event) {
+	if a == nil {
+		return
+	}
+	line, err := formatEvent(a.format, rec)
+	if err != nil {
+		log.Errorf("audit log format error %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(line)
+	a.w.WriteByte('\n')
+}
+
+// reopen flushes and reopens the file so rotated logs are picked up.
+func (a *auditLog) reopen() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Flush()
+	a.file.Close()
+	if err := a.open(); err != nil {
+		log.Errorf("audit log reopen error %v", err)
+		// Keep accepting records, they're dropped until the next reopen.
+		a.w = bufio.NewWriter(discard{})
+		return
+	}
+	log.Infof("Reopened audit log %s", a.path)
+}
+
+// close flushes and closes the file.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Flush()
+	a.file.Close()
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
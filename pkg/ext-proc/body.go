@@ -0,0 +1,143 @@
+package extproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// BodyInspector inspects response body messages of allowed requests and may
+// replace them, e.g. to swap a body that leaked a secret for a sanitized
+// placeholder instead of blocking the response. in.Phase is
+// PhaseResponseBody and in.Body is the chunk, or the whole body when the
+// filter buffers it. Returning a nil BodyVerdict leaves the chunk alone;
+// returning an error blocks the response, as it does for a Decider.
+type BodyInspector interface {
+	InspectBody(ctx context.Context, in *DecisionInput) (*BodyVerdict, error)
+}
+
+// BodyInspectorFunc adapts an ordinary function to the BodyInspector
+// interface.
+type BodyInspectorFunc func(ctx context.Context, in *DecisionInput) (*BodyVerdict, error)
+
+// InspectBody calls f(ctx, in).
+func (f BodyInspectorFunc) InspectBody(ctx context.Context, in *DecisionInput) (*BodyVerdict, error) {
+	return f(ctx, in)
+}
+
+// BodyVerdict is a BodyInspector's verdict on a response body chunk.
+type BodyVerdict struct {
+	// Replace swaps the chunk for Body.
+	Replace bool
+	Body    []byte
+	// ReasonText says why, for the logs, audit log and events.
+	ReasonText string
+}
+
+// replaceResponseBody runs Config.BodyInspectors on a response body message.
+// It returns the response to send, or nil when the chunk goes through
+// unchanged.
+//
+// A body that arrives in a single message, which is always the case with the
+// BUFFERED processing mode, is replaced whole and its content-length set to
+// the replacement's length; Envoy still holds the headers at that point. In
+// the STREAMED modes earlier chunks have already been forwarded, so the
+// matching chunk is replaced and the rest of the body cleared. The response
+// header phase drops content-length up front when inspectors are set, see
+// bodyInspectorHeaders.
+func replaceResponseBody(ctx context.Context, cfg *Config, stream *streamState, req *extProcPb.ProcessingRequest) *extProcPb.ProcessingResponse {
+	v, ok := req.Request.(*extProcPb.ProcessingRequest_ResponseBody)
+	if !ok || len(cfg.BodyInspectors) == 0 {
+		return nil
+	}
+	chunk := v.ResponseBody
+	first := !stream.responseBodyStarted
+	stream.responseBodyStarted = !chunk.EndOfStream
+
+	if stream.responseBodyReplaced {
+		return bodyMutationResponse(&extProcPb.BodyMutation{
+			Mutation: &extProcPb.BodyMutation_ClearBody{ClearBody: true},
+		}, nil)
+	}
+
+	in := &DecisionInput{
+		Config:          cfg,
+		Phase:           PhaseResponseBody,
+		UpstreamCluster: stream.upstreamCluster,
+		Body:            chunk.Body,
+		EndOfStream:     chunk.EndOfStream,
+		Attributes:      req.Attributes,
+	}
+	in.UpstreamIP, in.UpstreamSource = extractUpstreamAddress(cfg, req.Attributes)
+	for _, inspector := range cfg.BodyInspectors {
+		verdict, err := inspector.InspectBody(ctx, in)
+		if errors.Is(err, ErrInconclusive) {
+			return inconclusiveBody(cfg, stream, in.UpstreamIP, fmt.Sprintf("%s: %v", in.Phase, err))
+		}
+		if err != nil {
+			decision := decisionForError(err)
+			log.Printf("BLOCKED: %s - %s\n", in.Phase, decision.ReasonText)
+			stream.record(in.UpstreamIP, nil, decision)
+			resp := blockResponse(cfg, stream, decision, false)
+			resp.DynamicMetadata = decisionMetadata(cfg, stream, decision)
+			return resp
+		}
+		if verdict == nil || !verdict.Replace {
+			continue
+		}
+
+		whole := first && chunk.EndOfStream
+		stream.responseBodyReplaced = !chunk.EndOfStream
+		mode := "streamed"
+		if whole {
+			mode = "buffered"
+		}
+		bodyReplacementsTotal.WithLabelValues(mode).Inc()
+		log.Printf("REPLACED: %s - %s\n", in.Phase, verdict.ReasonText)
+		stream.record(in.UpstreamIP, nil,
+			Decision{Allow: true, ReasonCode: ReasonBodyReplaced, ReasonText: verdict.ReasonText})
+
+		var headers *extProcPb.HeaderMutation
+		if whole {
+			headers = &extProcPb.HeaderMutation{
+				SetHeaders: []*corev3.HeaderValueOption{setHeader("content-length", strconv.Itoa(len(verdict.Body)))},
+			}
+		}
+		return bodyMutationResponse(&extProcPb.BodyMutation{
+			Mutation: &extProcPb.BodyMutation_Body{Body: verdict.Body},
+		}, headers)
+	}
+	return nil
+}
+
+// bodyMutationResponse answers a response body message with mutation, and
+// headers when the response headers are still held.
+func bodyMutationResponse(mutation *extProcPb.BodyMutation, headers *extProcPb.HeaderMutation) *extProcPb.ProcessingResponse {
+	return &extProcPb.ProcessingResponse{
+		Response: &extProcPb.ProcessingResponse_ResponseBody{
+			ResponseBody: &extProcPb.BodyResponse{
+				Response: &extProcPb.CommonResponse{
+					Status:         extProcPb.CommonResponse_CONTINUE,
+					HeaderMutation: headers,
+					BodyMutation:   mutation,
+				},
+			},
+		},
+	}
+}
+
+// bodyInspectorHeaders returns the response headers to remove so a body
+// replacement can't disagree with them. With Config.BodyInspectors set
+// content-length is always dropped: a streamed body may be replaced after the
+// headers have gone out, and Envoy then frames the response with chunked
+// encoding, or END_STREAM on HTTP/2, instead.
+func bodyInspectorHeaders(cfg *Config) []string {
+	if len(cfg.BodyInspectors) == 0 {
+		return nil
+	}
+	return []string{"content-length"}
+}
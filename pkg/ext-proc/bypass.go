@@ -0,0 +1,68 @@
+package extproc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// SignBypass returns a Config.BypassHeader token for requests to authority,
+// valid until expires: "<unix seconds>.<hex HMAC-SHA256>" under secret. The
+// host and expiry bound where and how long a leaked token can be used; the
+// port and case of authority don't matter.
+func SignBypass(secret Secret, authority string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + bypassMAC(secret, normalizeHost(authority), exp)
+}
+
+func bypassMAC(secret Secret, host, exp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("bypass:" + exp + ":" + host))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bypassRequested reports whether the request carries a valid, unexpired
+// Config.BypassHeader token signed for its :authority. Invalid tokens are
+// logged and ignored.
+func bypassRequested(cfg *Config, headers *corev3.HeaderMap) bool {
+	if cfg.BypassHeader == "" {
+		return false
+	}
+	token := getHeader(headers, cfg.BypassHeader)
+	if token == "" {
+		return false
+	}
+
+	host := normalizeHost(getHeader(headers, ":authority"))
+	exp, mac, ok := strings.Cut(token, ".")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || host == "" || !hmac.Equal([]byte(mac), []byte(bypassMAC(cfg.BypassSecret, host, exp))) {
+		bypassTotal.WithLabelValues("invalid").Inc()
+		log.Warnf("Ignoring invalid %s token", cfg.BypassHeader)
+		return false
+	}
+	if time.Now().Unix() > expires {
+		bypassTotal.WithLabelValues("expired").Inc()
+		log.Warnf("Ignoring expired %s token", cfg.BypassHeader)
+		return false
+	}
+	return true
+}
+
+// bypass downgrades a block to an allow for a stream with a valid bypass
+// token, logging the decision it would have made.
+func bypass(stream *streamState, upstreamIP string, decision Decision) Decision {
+	bypassTotal.WithLabelValues("bypassed").Inc()
+	log.WithField("requestId", stream.requestID).Warnf("BYPASS: would block upstream IP %s - %s (%s)", upstreamIP, decision.ReasonText, decision.ReasonCode)
+	return Decision{
+		Allow:       true,
+		ReasonCode:  ReasonBypassed,
+		ReasonText:  "would block: " + string(decision.ReasonCode),
+		MatchedRule: decision.MatchedRule,
+	}
+}
@@ -0,0 +1,52 @@
+package extproc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBypassHeader(t *testing.T) {
+	const secret = Secret("s3cret")
+	cfg := useConfig(t, &Config{BypassHeader: "X-Extproc-Bypass", BypassSecret: secret})
+	token := SignBypass(secret, "internal.example:8080", time.Now().Add(time.Minute))
+
+	resps := runStream(t, requestHeaders("10.0.0.1:8080", ":authority", "Internal.Example", "X-Extproc-Bypass", token))
+	common := resps[0].GetRequestHeaders().GetResponse()
+	if common == nil {
+		t.Fatalf("response = %v, want the bypassed request to continue", resps[0])
+	}
+	removed := common.GetHeaderMutation().GetRemoveHeaders()
+	if len(removed) != 1 || removed[0] != "x-extproc-bypass" {
+		t.Errorf("RemoveHeaders = %v, want [x-extproc-bypass]", removed)
+	}
+
+	logged := redactedHeaders(cfg, headerMap("X-Extproc-Bypass", token))
+	if logged["x-extproc-bypass"] != redactedValue {
+		t.Errorf("logged token = %q, want it redacted", logged["x-extproc-bypass"])
+	}
+}
+
+func TestBypassHeaderExpired(t *testing.T) {
+	const secret = Secret("s3cret")
+	useConfig(t, &Config{BypassHeader: "X-Extproc-Bypass", BypassSecret: secret})
+	token := SignBypass(secret, "internal.example", time.Now().Add(-time.Minute))
+
+	resps := runStream(t, requestHeaders("10.0.0.1:8080", ":authority", "internal.example", "X-Extproc-Bypass", token))
+	if immediateStatus(resps[0]) == 0 {
+		t.Errorf("response = %v, want the expired token ignored and the request blocked", resps[0])
+	}
+}
+
+func TestBypassHeaderScope(t *testing.T) {
+	const secret = Secret("s3cret")
+	useConfig(t, &Config{BypassHeader: "X-Extproc-Bypass", BypassSecret: secret})
+	token := SignBypass(secret, "internal.example", time.Now().Add(time.Minute))
+
+	// A token leaked from one incident doesn't open other destinations.
+	for _, authority := range []string{"other.example", "internal.example.evil", ""} {
+		resps := runStream(t, requestHeaders("10.0.0.1:8080", ":authority", authority, "X-Extproc-Bypass", token))
+		if immediateStatus(resps[0]) == 0 {
+			t.Errorf("authority %q: response = %v, want the token ignored and the request blocked", authority, resps[0])
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package extproc
+
+import (
+	"net"
+)
+
+// cidrTrie is a path-compressed binary radix tree of CIDRs supporting
+// longest-prefix match. IPv4 and IPv6 are kept in separate trees keyed on the
+// 4 and 16 byte address forms, IPv4-mapped CIDRs going in the IPv4 tree.
+type cidrTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	key  []byte
+	bits int
+	// net is set when this node is an inserted CIDR rather than a branch.
+	net   *net.IPNet
+	child [2]*trieNode
+}
+
+// newCIDRTrie builds a trie from nets.
+func newCIDRTrie(nets []*net.IPNet) *cidrTrie {
+	t := &cidrTrie{}
+	for _, n := range nets {
+		t.insert(n)
+	}
+	return t
+}
+
+func (t *cidrTrie) root(ip []byte) **trieNode {
+	if len(ip) == net.IPv4len {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+func (t *cidrTrie) insert(n *net.IPNet) {
+	ones, _ := n.Mask.Size()
+	key := n.IP.Mask(n.Mask)
+	// An IPv4-mapped CIDR (::ffff:10.0.0.0/104) covers IPv4 addresses, which
+	// lookup searches for in the IPv4 tree, as IPNet.Contains does.
+	if ip4 := key.To4(); ip4 != nil && len(key) == net.IPv6len {
+		key, ones = ip4, ones-96
+	}
+	node := &trieNode{key: key, bits: ones, net: n}
+
+	p := t.root(key)
+	for {
+		cur := *p
+		if cur == nil {
+			*p = node
+			return
+		}
+
+		common := commonPrefixLen(cur.key, key, min(cur.bits, ones))
+		switch {
+		case common == cur.bits && common == ones:
+			// Duplicate prefix, the first one inserted wins
+			if cur.net == nil {
+				cur.net = n
+			}
+			return
+		case common == cur.bits:
+			p = &cur.child[bitAt(key, cur.bits)]
+		case common == ones:
+			node.child[bitAt(cur.key, ones)] = cur
+			*p = node
+			return
+		default:
+			branch := &trieNode{key: maskBits(key, common), bits: common}
+			branch.child[bitAt(key, common)] = node
+			branch.child[bitAt(cur.key, common)] = cur
+			*p = branch
+			return
+		}
+	}
+}
+
+// lookup returns the longest CIDR containing ip, or nil.
+func (t *cidrTrie) lookup(ip net.IP) *net.IPNet {
+	if t == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if ip = ip.To16(); ip == nil {
+		return nil
+	}
+
+	var best *net.IPNet
+	for cur := *t.root(ip); cur != nil; {
+		if commonPrefixLen(cur.key, ip, cur.bits) < cur.bits {
+			break
+		}
+		if cur.net != nil {
+			best = cur.net
+		}
+		if cur.bits == len(ip)*8 {
+			break
+		}
+		cur = cur.child[bitAt(ip, cur.bits)]
+	}
+	return best
+}
+
+// bitAt returns bit i of key, counting from the most significant bit.
+func bitAt(key []byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+// commonPrefixLen returns how many leading bits of a and b match, up to max.
+func commonPrefixLen(a, b []byte, max int) int {
+	n := 0
+	for i := 0; i < len(a) && i < len(b) && n < max; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// maskBits returns a copy of key with all but the first bits cleared.
+func maskBits(key []byte, bits int) []byte {
+	return net.IP(key).Mask(net.CIDRMask(bits, len(key)*8))
+}
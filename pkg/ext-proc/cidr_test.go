@@ -0,0 +1,157 @@
+package extproc
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"testing"
+)
+
+// linearLookup is the scan the trie replaces: the longest CIDR in nets
+// containing ip, by IPNet.Contains.
+func linearLookup(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	var best *net.IPNet
+	bestOnes := -1
+	for _, n := range nets {
+		if n.Contains(ip) && effectiveOnes(n) > bestOnes {
+			best, bestOnes = n, effectiveOnes(n)
+		}
+	}
+	return best
+}
+
+// effectiveOnes is the prefix length of n in the address family it matches,
+// so ::ffff:10.0.0.0/104 and 10.0.0.0/8 compare equal.
+func effectiveOnes(n *net.IPNet) int {
+	ones, bits := n.Mask.Size()
+	if bits == 8*net.IPv6len && n.IP.To4() != nil {
+		return ones - 96
+	}
+	return ones
+}
+
+func randomIP(r *rand.Rand, v6 bool) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	if v6 {
+		ip = make(net.IP, net.IPv6len)
+	}
+	for i := range ip {
+		ip[i] = byte(r.IntN(256))
+	}
+	return ip
+}
+
+// randomNets returns n random IPv4, IPv6 and IPv4-mapped CIDRs.
+func randomNets(r *rand.Rand, n int) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, n)
+	for len(nets) < n {
+		var cidr string
+		switch r.IntN(3) {
+		case 0:
+			cidr = fmt.Sprintf("%s/%d", randomIP(r, false), r.IntN(33))
+		case 1:
+			cidr = fmt.Sprintf("%s/%d", randomIP(r, true), r.IntN(129))
+		default:
+			cidr = fmt.Sprintf("::ffff:%s/%d", randomIP(r, false), 96+r.IntN(33))
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// nearIP returns an address inside or just around one of nets, so lookups
+// hit as well as miss.
+func nearIP(r *rand.Rand, nets []*net.IPNet) net.IP {
+	n := nets[r.IntN(len(nets))]
+	ip := append(net.IP(nil), n.IP...)
+	ip[len(ip)-1] ^= byte(r.IntN(256))
+	if r.IntN(4) == 0 {
+		ip[r.IntN(len(ip))] ^= 1 << r.IntN(8)
+	}
+	return ip
+}
+
+func TestCIDRTrieMatchesLinear(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for round := 0; round < 50; round++ {
+		nets := randomNets(r, 1+r.IntN(200))
+		trie := newCIDRTrie(nets)
+		for i := 0; i < 500; i++ {
+			ip := nearIP(r, nets)
+			if i%2 == 0 {
+				ip = randomIP(r, r.IntN(2) == 0)
+			}
+			want := linearLookup(nets, ip)
+			got := trie.lookup(ip)
+			if (got == nil) != (want == nil) {
+				t.Fatalf("lookup(%s) = %v, linear scan = %v", ip, got, want)
+			}
+			if got != nil && (!got.Contains(ip) || effectiveOnes(got) != effectiveOnes(want)) {
+				t.Fatalf("lookup(%s) = %v, linear scan = %v", ip, got, want)
+			}
+		}
+	}
+}
+
+func TestCIDRTrieMappedCIDR(t *testing.T) {
+	nets, err := parseCIDRs([]string{"::ffff:10.0.0.0/104", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trie := newCIDRTrie(nets)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.1.2.3", "10.0.0.0/8"},
+		{"::ffff:10.1.2.3", "10.0.0.0/8"},
+		{"11.1.2.3", ""},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"::a01:203", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if n := trie.lookup(net.ParseIP(tt.ip)); n != nil {
+			got = n.String()
+		}
+		if got != tt.want {
+			t.Errorf("lookup(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestDeniedMappedCIDR(t *testing.T) {
+	cfg := &Config{DeniedCIDRs: []string{"::ffff:93.184.216.0/120"}}
+	d := Evaluate(cfg, requestHeaders("93.184.216.34:443"))
+	if d.Allow || d.ReasonCode != ReasonDeniedCIDR {
+		t.Errorf("Evaluate() = %+v, want %s", d, ReasonDeniedCIDR)
+	}
+}
+
+func BenchmarkCIDRLookup(b *testing.B) {
+	for _, size := range []int{10, 1000, 100000} {
+		r := rand.New(rand.NewPCG(3, 4))
+		nets := randomNets(r, size)
+		trie := newCIDRTrie(nets)
+		ips := make([]net.IP, 1024)
+		for i := range ips {
+			ips[i] = nearIP(r, nets)
+		}
+
+		b.Run(fmt.Sprintf("linear/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearLookup(nets, ips[i%len(ips)])
+			}
+		})
+		b.Run(fmt.Sprintf("trie/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				trie.lookup(ips[i%len(ips)])
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package extproc
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Debug server timeouts used when the config leaves them at zero. They bound
+// how long a slow or idle client can hold a connection.
+const (
+	defaultDebugReadHeaderTimeout = 5 * time.Second
+	defaultDebugReadTimeout       = 10 * time.Second
+	defaultDebugWriteTimeout      = 30 * time.Second
+	defaultDebugIdleTimeout       = 60 * time.Second
+)
+
+// newDebugServer returns the HTTP server for the debug endpoints, or nil when
+// the debug port is disabled.
+func newDebugServer() *http.Server {
+	if config.DebugPort == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/recent-blocks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, recentBlocks.list())
+	})
+	mux.HandleFunc("/explain", explainIP)
+
+	return &http.Server{
+		Addr:              net.JoinHostPort(config.BindAddress, strconv.Itoa(int(config.DebugPort))),
+		Handler:           mux,
+		ReadHeaderTimeout: orDefault(config.DebugReadHeaderTimeout, defaultDebugReadHeaderTimeout),
+		ReadTimeout:       orDefault(config.DebugReadTimeout, defaultDebugReadTimeout),
+		WriteTimeout:      orDefault(config.DebugWriteTimeout, defaultDebugWriteTimeout),
+		IdleTimeout:       orDefault(config.DebugIdleTimeout, defaultDebugIdleTimeout),
+	}
+}
+
+// explanation is the /explain response.
+type explanation struct {
+	IP          string     `json:"ip"`
+	Allowed     bool       `json:"allowed"`
+	ReasonCode  ReasonCode `json:"reasonCode"`
+	Reason      string     `json:"reason,omitempty"`
+	MatchedRule string     `json:"matchedRule,omitempty"`
+	Checks      checkTrace `json:"checks"`
+}
+
+// explainIP runs the IP safety checks for the ip query parameter and returns
+// each check evaluated along with the verdict. The other Deciders aren't run.
+func explainIP(w http.ResponseWriter, r *http.Request) {
+	ip, _, err := normalizeAddress(r.URL.Query().Get("ip"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var trace checkTrace
+	d := traceUpstreamIP(activeConfig(), ip, &trace)
+	writeJSON(w, explanation{
+		IP:          ip.String(),
+		Allowed:     d.Allow,
+		ReasonCode:  d.ReasonCode,
+		Reason:      d.ReasonText,
+		MatchedRule: d.MatchedRule,
+		Checks:      trace,
+	})
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("debug response error %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+package extproc
+
+import (
+	"testing"
+)
+
+func TestDebugServerAddr(t *testing.T) {
+	tests := []struct {
+		bind string
+		want string
+	}{
+		{"0.0.0.0", "0.0.0.0:9001"},
+		{"::", "[::]:9001"},
+		{"fd00::1", "[fd00::1]:9001"},
+		{"", ":9001"},
+	}
+	for _, tt := range tests {
+		useConfig(t, &Config{BindAddress: tt.bind, DebugPort: 9001})
+		if got := newDebugServer().Addr; got != tt.want {
+			t.Errorf("BindAddress %q: Addr = %q, want %q", tt.bind, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package extproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Phase identifies the ext_proc message a decision is being made for.
+type Phase string
+
+// Processing phases.
+const (
+	PhaseRequestHeaders  Phase = "request_headers"
+	PhaseResponseHeaders Phase = "response_headers"
+	// Body phases are only evaluated with Config.InspectBodies.
+	PhaseRequestBody  Phase = "request_body"
+	PhaseResponseBody Phase = "response_body"
+)
+
+// DecisionInput carries everything a Decider may base its verdict on.
+type DecisionInput struct {
+	// Config is the configuration the decision is evaluated against.
+	Config *Config
+	Phase  Phase
+	// UpstreamIP is the upstream address as reported by Envoy. It may carry a
+	// port and is empty when the attribute is missing.
+	UpstreamIP string
+	// UpstreamSource is the attribute source UpstreamIP was read from, as
+	// namespace:path.
+	UpstreamSource string
+	// UpstreamCluster is the xds.cluster_name attribute, empty when Envoy
+	// didn't send it.
+	UpstreamCluster string
+	// SNI is the connection.requested_server_name attribute, empty when
+	// Envoy didn't send it or the connection has no TLS.
+	SNI string
+	// UpstreamCountry and UpstreamASN are looked up in Config.GeoIPDBPath,
+	// empty and zero when it isn't set or has no entry for the IP.
+	UpstreamCountry string
+	UpstreamASN     uint
+	Headers         *corev3.HeaderMap
+	// Body is the chunk, or whole body when buffered, in the body phases.
+	// EndOfStream is set on the last chunk.
+	Body        []byte
+	EndOfStream bool
+	Attributes  map[string]*structpb.Struct
+}
+
+// Decider evaluates a request. Returning a nil Decision defers to the next
+// Decider in the chain; returning an error blocks the request. Return one of
+// the Err values in errors.go to get its specific reason code.
+type Decider interface {
+	Decide(ctx context.Context, in *DecisionInput) (*Decision, error)
+}
+
+// DeciderFunc adapts an ordinary function to the Decider interface.
+type DeciderFunc func(ctx context.Context, in *DecisionInput) (*Decision, error)
+
+// Decide calls f(ctx, in).
+func (f DeciderFunc) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	return f(ctx, in)
+}
+
+// IPSafetyDecider is the built-in Decider that blocks loopback, private,
+// link-local and other unsafe upstream addresses, or runs Config.IPCheckers
+// when set. It always reaches a verdict in the request header phase and
+// defers in every other phase.
+type IPSafetyDecider struct{}
+
+// Decide implements Decider.
+func (IPSafetyDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	if in.Phase != PhaseRequestHeaders {
+		return nil, nil
+	}
+
+	// A blank attribute is as good as a missing one.
+	if strings.TrimSpace(in.UpstreamIP) == "" {
+		if hasFilterAttributes(in.Config, in.Attributes) {
+			if in.Config.FailureMode == FailureModeOpen {
+				d := failOpen(ReasonExtraction, "upstream address attribute is missing")
+				return &d, nil
+			}
+			return nil, ErrExtraction
+		}
+		if !in.Config.AllowMissingAttributes && in.Config.FailureMode != FailureModeOpen {
+			return nil, ErrAttributesMissing
+		}
+		d := failOpen(ReasonAttributesMissing, "ext_proc attributes are missing, check request_attributes on the Envoy filter")
+		return &d, nil
+	}
+
+	ip, _, err := normalizeAddress(in.UpstreamIP)
+	if errors.Is(err, ErrInvalidAddress) {
+		return invalidAddress(in.Config, in.UpstreamIP, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	d, err := checkIP(ctx, in.Config, ip)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// invalidAddress applies Config.InvalidAddress to an upstream address that
+// didn't parse.
+func invalidAddress(cfg *Config, addr string, err error) (*Decision, error) {
+	action := cfg.InvalidAddress
+	if action == "" {
+		action = InvalidAddressBlock
+	}
+	invalidAddressTotal.WithLabelValues(action).Inc()
+
+	switch action {
+	case InvalidAddressAllow:
+		return &Decision{Allow: true, ReasonCode: ReasonInvalidAddress, ReasonText: err.Error()}, nil
+	case InvalidAddressLog:
+		d := failOpen(ReasonInvalidAddress, fmt.Sprintf("upstream address %q: %v", addr, err))
+		return &d, nil
+	default:
+		return nil, err
+	}
+}
+
+// ReverseLookupDecider is the built-in Decider that reverse-resolves the
+// upstream IP when Config.ReverseLookup is set and blocks if any PTR name
+// matches Config.DeniedHosts. PTR records are controlled by whoever owns the
+// address, so this only adds blocks, it never allows. It defers otherwise.
+// When Config.MaxConcurrentChecks lookups are running and none finishes in
+// time it returns ErrChecksSaturated, or defers with FailureModeOpen.
+type ReverseLookupDecider struct{}
+
+// Decide implements Decider.
+func (ReverseLookupDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	lookups := in.Config.compiled.reverseLookups
+	if in.Phase != PhaseRequestHeaders || lookups == nil || len(in.Config.DeniedHosts) == 0 {
+		return nil, nil
+	}
+
+	ip, _, err := normalizeAddress(in.UpstreamIP)
+	if err != nil {
+		// Left to IPSafetyDecider.
+		return nil, nil
+	}
+
+	names, err := lookups.names(ctx, ip)
+	if errors.Is(err, ErrChecksSaturated) {
+		if in.Config.FailureMode != FailureModeOpen {
+			return nil, err
+		}
+		// Counted and warned about as a fail-open, but the rest of the
+		// chain still runs.
+		failOpen(ReasonChecksSaturated, err.Error())
+		return nil, nil
+	}
+	if err != nil {
+		if in.Config.ReverseLookupFailClosed {
+			return nil, fmt.Errorf("%w: %v", ErrReverseLookup, err)
+		}
+		log.Debugf("Reverse lookup of %s failed: %v", ip, err)
+		return nil, nil
+	}
+	for _, name := range names {
+		if pattern := in.Config.compiled.deniedHosts.match(name); pattern != "" {
+			d := blocked(ReasonDeniedHost, "reverse DNS name "+normalizeHost(name)+" is denied", pattern)
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+
+// HeaderLimitDecider is the built-in Decider that blocks requests with more
+// than Config.MaxRequestHeaders headers or more than Config.MaxHeaderBytes of
+// header names and values, with a 431. It defers otherwise.
+type HeaderLimitDecider struct{}
+
+// Decide implements Decider.
+func (HeaderLimitDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	if in.Phase != PhaseRequestHeaders || in.Headers == nil {
+		return nil, nil
+	}
+
+	count := len(in.Headers.Headers)
+	if in.Config.MaxRequestHeaders > 0 && count > in.Config.MaxRequestHeaders {
+		d := blocked(ReasonHeaderLimit, fmt.Sprintf("too many request headers (%d > %d)", count, in.Config.MaxRequestHeaders), "max-request-headers")
+		d.StatusCode = http.StatusRequestHeaderFieldsTooLarge
+		return &d, nil
+	}
+
+	if in.Config.MaxHeaderBytes > 0 {
+		size := 0
+		for _, h := range in.Headers.Headers {
+			size += len(h.Key) + len(h.Value) + len(h.RawValue)
+		}
+		if size > in.Config.MaxHeaderBytes {
+			d := blocked(ReasonHeaderLimit, fmt.Sprintf("request headers too large (%d > %d bytes)", size, in.Config.MaxHeaderBytes), "max-header-bytes")
+			d.StatusCode = http.StatusRequestHeaderFieldsTooLarge
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+
+// MethodPolicyDecider is the built-in Decider that, when
+// Config.AllowedMethods is set, blocks requests whose :method isn't listed
+// with a 405. Methods are compared case-sensitively. It defers otherwise.
+type MethodPolicyDecider struct{}
+
+// Decide implements Decider.
+func (MethodPolicyDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	if in.Phase != PhaseRequestHeaders || len(in.Config.AllowedMethods) == 0 {
+		return nil, nil
+	}
+
+	method := getHeader(in.Headers, ":method")
+	for _, allowed := range in.Config.AllowedMethods {
+		if method == allowed {
+			return nil, nil
+		}
+	}
+	d := blocked(ReasonMethodNotAllowed, "method "+method+" is not allowed", "allowed-methods")
+	d.StatusCode = http.StatusMethodNotAllowed
+	return &d, nil
+}
+
+// ContentTypePolicyDecider is the built-in Decider that blocks requests whose
+// content type is in Config.DeniedContentTypes, or not in
+// Config.AllowedContentTypes when that is set, with a 415. Types are compared
+// without parameters. Requests without a content type follow
+// Config.MissingContentType. It defers otherwise.
+type ContentTypePolicyDecider struct{}
+
+// Decide implements Decider.
+func (ContentTypePolicyDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	cfg := in.Config
+	if in.Phase != PhaseRequestHeaders || (len(cfg.DeniedContentTypes) == 0 && len(cfg.AllowedContentTypes) == 0) {
+		return nil, nil
+	}
+
+	contentType := mediaType(getHeader(in.Headers, "content-type"))
+	if contentType == "" {
+		if cfg.MissingContentType == MissingContentTypeBlock {
+			d := blocked(ReasonContentType, "request content type is missing", "missing-content-type")
+			d.StatusCode = http.StatusUnsupportedMediaType
+			return &d, nil
+		}
+		return nil, nil
+	}
+
+	for _, denied := range cfg.DeniedContentTypes {
+		if contentType == mediaType(denied) {
+			d := blocked(ReasonContentType, "request content type "+contentType+" is denied", denied)
+			d.StatusCode = http.StatusUnsupportedMediaType
+			return &d, nil
+		}
+	}
+	if len(cfg.AllowedContentTypes) == 0 {
+		return nil, nil
+	}
+	for _, allowed := range cfg.AllowedContentTypes {
+		if contentType == mediaType(allowed) {
+			return nil, nil
+		}
+	}
+	d := blocked(ReasonContentType, "request content type "+contentType+" is not allowed", "allowed-content-types")
+	d.StatusCode = http.StatusUnsupportedMediaType
+	return &d, nil
+}
+
+// HostPolicyDecider is the built-in Decider that blocks requests whose
+// :authority matches Config.DeniedHosts or, with
+// Config.EnforceAuthoritySNIMatch, differs from the TLS SNI. It defers for
+// every other request.
+type HostPolicyDecider struct{}
+
+// Decide implements Decider.
+func (HostPolicyDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	if in.Phase != PhaseRequestHeaders {
+		return nil, nil
+	}
+
+	authority := getHeader(in.Headers, ":authority")
+	if in.Config.EnforceAuthoritySNIMatch && in.SNI != "" {
+		host, sni := normalizeHost(authority), normalizeHost(in.SNI)
+		if host != sni {
+			d := blocked(ReasonAuthorityMismatch, "host "+host+" doesn't match TLS server name "+sni, "authority-sni-match")
+			return &d, nil
+		}
+	}
+	if pattern := in.Config.compiled.deniedHosts.match(authority); pattern != "" {
+		d := blocked(ReasonDeniedHost, "host "+normalizeHost(authority)+" is denied", pattern)
+		return &d, nil
+	}
+	return nil, nil
+}
+
+// ClusterPolicyDecider is the built-in Decider that blocks requests routed to
+// a cluster in Config.DeniedClusters and allows those routed to one in
+// Config.AllowedClusters, regardless of the upstream IP. Denied wins. It
+// defers when the cluster is unknown or listed in neither.
+type ClusterPolicyDecider struct{}
+
+// Decide implements Decider.
+func (ClusterPolicyDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	if in.Phase != PhaseRequestHeaders || in.UpstreamCluster == "" {
+		return nil, nil
+	}
+
+	if slices.Contains(in.Config.DeniedClusters, in.UpstreamCluster) {
+		d := blocked(ReasonDeniedCluster, "cluster "+in.UpstreamCluster+" is denied", in.UpstreamCluster)
+		return &d, nil
+	}
+	if slices.Contains(in.Config.AllowedClusters, in.UpstreamCluster) {
+		return &Decision{Allow: true, ReasonCode: ReasonAllowedCluster, MatchedRule: in.UpstreamCluster}, nil
+	}
+	return nil, nil
+}
+
+// GeoPolicyDecider is the built-in Decider that blocks upstreams whose GeoIP
+// country is in Config.DeniedCountries or whose ASN is in Config.DeniedASNs.
+// It defers otherwise, including when no GeoIP database is configured.
+type GeoPolicyDecider struct{}
+
+// Decide implements Decider.
+func (GeoPolicyDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	if in.Phase != PhaseRequestHeaders {
+		return nil, nil
+	}
+
+	if in.UpstreamCountry != "" {
+		for _, country := range in.Config.DeniedCountries {
+			if strings.EqualFold(country, in.UpstreamCountry) {
+				d := blocked(ReasonDeniedCountry, "upstream country "+in.UpstreamCountry+" is denied", country)
+				return &d, nil
+			}
+		}
+	}
+	if in.UpstreamASN != 0 && slices.Contains(in.Config.DeniedASNs, in.UpstreamASN) {
+		asn := fmt.Sprintf("AS%d", in.UpstreamASN)
+		d := blocked(ReasonDeniedASN, "upstream "+asn+" is denied", asn)
+		return &d, nil
+	}
+	return nil, nil
+}
+
+// ForwardedForDecider is the built-in Decider that, when
+// Config.CheckForwardedFor is set, runs every x-forwarded-for hop through the
+// IP safety checks and blocks if any hop is unsafe. It defers otherwise.
+type ForwardedForDecider struct{}
+
+// Decide implements Decider.
+func (ForwardedForDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	if !in.Config.CheckForwardedFor || in.Phase != PhaseRequestHeaders {
+		return nil, nil
+	}
+
+	xff := getHeader(in.Headers, "x-forwarded-for")
+	if xff == "" {
+		return nil, nil
+	}
+
+	for _, hop := range strings.Split(xff, ",") {
+		ip, _, err := normalizeAddress(hop)
+		if err != nil {
+			if in.Config.ForwardedForMalformed == ForwardedForSkip {
+				continue
+			}
+			d := blocked(ReasonForwardedFor, "malformed x-forwarded-for hop "+strings.TrimSpace(hop), "x-forwarded-for")
+			return &d, nil
+		}
+
+		d, err := checkIP(ctx, in.Config, ip)
+		if err != nil {
+			return nil, err
+		}
+		if !d.Allow {
+			d.ReasonCode = ReasonForwardedFor
+			d.ReasonText = "x-forwarded-for hop " + ip.String() + ": " + d.ReasonText
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+
+// ResponsePolicyDecider is the built-in Decider for the response header
+// phase. It blocks responses whose content type is listed in
+// Config.ResponseDeniedContentTypes or whose status matches a
+// ResponseStatusBlock rule, and allows the rest, independently of the request
+// verdict.
+type ResponsePolicyDecider struct{}
+
+// Decide implements Decider.
+func (ResponsePolicyDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	if in.Phase != PhaseResponseHeaders {
+		return nil, nil
+	}
+
+	contentType := mediaType(getHeader(in.Headers, "content-type"))
+	for _, denied := range in.Config.ResponseDeniedContentTypes {
+		if contentType != "" && contentType == mediaType(denied) {
+			d := blocked(ReasonResponseContentType, "response content type "+contentType+" is blocked", denied)
+			return &d, nil
+		}
+	}
+	if rule := matchResponseStatus(in.Config, in.Headers); rule != nil && rule.Action == ResponseStatusBlock {
+		d := blocked(ReasonResponseStatus, "upstream response status "+getHeader(in.Headers, ":status")+" is blocked", rule.String())
+		d.StatusCode = http.StatusBadGateway
+		return &d, nil
+	}
+	return &Decision{Allow: true, ReasonCode: ReasonAllowed}, nil
+}
+
+// deciders returns the configured chain, defaulting to the built-in request
+// and response policies. A phase that no Decider reaches a verdict for is
+// blocked, so allowing a request never implicitly allows its response.
+func deciders(cfg *Config) []Decider {
+	if len(cfg.Deciders) == 0 {
+		return []Decider{
+			HeaderLimitDecider{},
+			MethodPolicyDecider{},
+			ContentTypePolicyDecider{},
+			HostPolicyDecider{},
+			ClusterPolicyDecider{},
+			TrustedHeaderDecider{},
+			GeoPolicyDecider{},
+			ForwardedForDecider{},
+			ReverseLookupDecider{},
+			IPSafetyDecider{},
+			ResponsePolicyDecider{},
+		}
+	}
+	return cfg.Deciders
+}
+
+// runDeciders evaluates the chain until a Decider reaches a verdict. A chain
+// that never reaches one blocks the request.
+func runDeciders(ctx context.Context, in *DecisionInput) Decision {
+	for _, d := range deciders(in.Config) {
+		decision, err := d.Decide(ctx, in)
+		if err != nil {
+			return decisionForError(err)
+		}
+		if decision != nil {
+			return *decision
+		}
+	}
+	return decisionForError(ErrNoVerdict)
+}
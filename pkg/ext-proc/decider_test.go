@@ -0,0 +1,60 @@
+package extproc
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	// Each x-pad header is 5 bytes of name plus its value.
+	pad := func(n int) string { return strings.Repeat("a", n) }
+
+	tests := []struct {
+		name    string
+		cfg     *Config
+		headers []string
+		blocked bool
+	}{
+		{"count at limit", &Config{MaxRequestHeaders: 3}, []string{"a", "1", "b", "2", "c", "3"}, false},
+		{"count over limit", &Config{MaxRequestHeaders: 3}, []string{"a", "1", "b", "2", "c", "3", "d", "4"}, true},
+		{"bytes at limit", &Config{MaxHeaderBytes: 64}, []string{"x-pad", pad(59)}, false},
+		{"bytes over limit", &Config{MaxHeaderBytes: 64}, []string{"x-pad", pad(60)}, true},
+		{"bytes summed", &Config{MaxHeaderBytes: 64}, []string{"x-pad", pad(27), "x-pad", pad(28)}, true},
+		{"unlimited", &Config{}, []string{"x-pad", pad(4096)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.cfg)
+			resps := runStream(t, requestHeaders("93.184.216.34:443", tt.headers...))
+			if len(resps) != 1 {
+				t.Fatalf("got %d responses, want 1", len(resps))
+			}
+			got := immediateStatus(resps[0])
+			if !tt.blocked {
+				if resps[0].GetRequestHeaders().GetResponse().GetStatus() != extProcPb.CommonResponse_CONTINUE {
+					t.Errorf("response = %v, want CONTINUE", resps[0])
+				}
+				return
+			}
+			if got != typev3.StatusCode_RequestHeaderFieldsTooLarge {
+				t.Errorf("status = %v, want RequestHeaderFieldsTooLarge", got)
+			}
+		})
+	}
+}
+
+func TestHeaderLimitRawValue(t *testing.T) {
+	cfg := &Config{MaxHeaderBytes: 16}
+	req := requestHeaders("93.184.216.34:443")
+	req.GetRequestHeaders().Headers.Headers = append(req.GetRequestHeaders().Headers.Headers,
+		&corev3.HeaderValue{Key: "x-raw", RawValue: []byte(strings.Repeat("a", 12))})
+	d := Evaluate(cfg, req)
+	if d.Allow || d.ReasonCode != ReasonHeaderLimit || d.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Evaluate() = %+v, want a 431 %s", d, ReasonHeaderLimit)
+	}
+}
@@ -0,0 +1,180 @@
+package extproc
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// ReasonCode is a stable identifier for why a decision was made.
+type ReasonCode string
+
+// Reason codes.
+const (
+	ReasonAllowed             ReasonCode = "ALLOWED"
+	ReasonAllowedCIDR         ReasonCode = "ALLOWED_CIDR"
+	ReasonAllowedMetadata     ReasonCode = "ALLOWED_METADATA"
+	ReasonTrustedHeader       ReasonCode = "TRUSTED_HEADER"
+	ReasonBypassed            ReasonCode = "BYPASSED"
+	ReasonDeniedCIDR          ReasonCode = "DENIED_CIDR"
+	ReasonNotAllowlisted      ReasonCode = "NOT_ALLOWLISTED"
+	ReasonDeniedHost          ReasonCode = "DENIED_HOST"
+	ReasonAuthorityMismatch   ReasonCode = "AUTHORITY_SNI_MISMATCH"
+	ReasonDeniedCluster       ReasonCode = "DENIED_CLUSTER"
+	ReasonDeniedCountry       ReasonCode = "DENIED_COUNTRY"
+	ReasonDeniedASN           ReasonCode = "DENIED_ASN"
+	ReasonAllowedCluster      ReasonCode = "ALLOWED_CLUSTER"
+	ReasonHeaderLimit         ReasonCode = "HEADER_LIMIT"
+	ReasonMethodNotAllowed    ReasonCode = "METHOD_NOT_ALLOWED"
+	ReasonContentType         ReasonCode = "CONTENT_TYPE"
+	ReasonBodyChunkLimit      ReasonCode = "BODY_CHUNK_LIMIT"
+	ReasonInconclusiveBody    ReasonCode = "BODY_INCONCLUSIVE"
+	ReasonBodyReplaced        ReasonCode = "BODY_REPLACED"
+	ReasonForwardedFor        ReasonCode = "FORWARDED_FOR"
+	ReasonLoopback            ReasonCode = "LOOPBACK"
+	ReasonUnspecified         ReasonCode = "UNSPECIFIED"
+	ReasonLinkLocal           ReasonCode = "LINK_LOCAL"
+	ReasonMulticast           ReasonCode = "MULTICAST"
+	ReasonPrivate             ReasonCode = "PRIVATE"
+	ReasonMetadata            ReasonCode = "METADATA"
+	ReasonDocumentation       ReasonCode = "DOCUMENTATION"
+	ReasonReserved            ReasonCode = "RESERVED"
+	ReasonInvalidAddress      ReasonCode = "INVALID_ADDRESS"
+	ReasonExtraction          ReasonCode = "EXTRACTION_FAILED"
+	ReasonReverseLookup       ReasonCode = "REVERSE_LOOKUP_FAILED"
+	ReasonChecksSaturated     ReasonCode = "CHECKS_SATURATED"
+	ReasonAttributesMissing   ReasonCode = "ATTRIBUTES_MISSING"
+	ReasonResponseContentType ReasonCode = "RESPONSE_CONTENT_TYPE"
+	ReasonResponseStatus      ReasonCode = "RESPONSE_STATUS"
+	ReasonDeciderError        ReasonCode = "DECIDER_ERROR"
+	ReasonDecisionTimeout     ReasonCode = "DECISION_TIMEOUT"
+	ReasonOverloaded          ReasonCode = "OVERLOADED"
+	ReasonNoVerdict           ReasonCode = "NO_VERDICT"
+	ReasonInvalidConfig       ReasonCode = "INVALID_CONFIG"
+	ReasonPhaseNotEvaluated   ReasonCode = "PHASE_NOT_EVALUATED"
+)
+
+// Decision is the allow/block verdict for a request.
+type Decision struct {
+	Allow      bool
+	ReasonCode ReasonCode
+	ReasonText string
+	// MatchedRule names the rule or CIDR that produced the decision, if any.
+	MatchedRule string
+	// StatusCode is the HTTP status returned to the client on block.
+	StatusCode int
+}
+
+// blocked returns a blocking decision with the default 403 status.
+func blocked(code ReasonCode, text, rule string) Decision {
+	return Decision{
+		ReasonCode:  code,
+		ReasonText:  text,
+		MatchedRule: rule,
+		StatusCode:  http.StatusForbidden,
+	}
+}
+
+// Evaluate runs the policy in cfg against a single processing request, the
+// same way Process does, without a gRPC stream. cfg isn't modified, so it may
+// be shared by concurrent calls; if it wasn't passed to Init or Validate, a
+// copy of it is validated on every call.
+func Evaluate(cfg *Config, req *extProcPb.ProcessingRequest) Decision {
+	if cfg.compiled == nil {
+		var err error
+		if cfg, err = validatedCopy(cfg); err != nil {
+			return blocked(ReasonInvalidConfig, err.Error(), "")
+		}
+	}
+	return evaluate(context.Background(), cfg, req)
+}
+
+// Simulate returns the response Process would send for req as the first
+// message of a stream, along with the decision behind it, without a gRPC
+// stream. The decision isn't recorded in the audit log or event sink and
+// doesn't count toward Config.MaxRequests, and cfg isn't modified. Meant for
+// offline debugging.
+func Simulate(cfg *Config, req *extProcPb.ProcessingRequest) (*extProcPb.ProcessingResponse, Decision, error) {
+	cfg, err := validatedCopy(cfg)
+	if err != nil {
+		return nil, Decision{}, err
+	}
+	resp, decision := decideWith(context.Background(), cfg, &streamState{start: time.Now()}, req)
+	return resp, decision, nil
+}
+
+// validatedCopy returns a validated shallow copy of cfg, leaving cfg alone.
+func validatedCopy(cfg *Config) (*Config, error) {
+	c := *cfg
+	c.compiled = nil
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func evaluate(ctx context.Context, cfg *Config, req *extProcPb.ProcessingRequest) Decision {
+	in := decisionInput(cfg, req)
+	if in == nil {
+		return Decision{Allow: true, ReasonCode: ReasonPhaseNotEvaluated}
+	}
+
+	if timeout := decisionTimeout(cfg, in); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return runDeciders(ctx, in)
+}
+
+// decisionTimeout returns the deadline for the Decider chain. A valid
+// Config.TimeoutHeader on the request overrides Config.DecisionTimeout, capped
+// at Config.MaxDecisionTimeout. Zero means no deadline.
+func decisionTimeout(cfg *Config, in *DecisionInput) time.Duration {
+	timeout := cfg.DecisionTimeout
+	if cfg.TimeoutHeader == "" || in.Phase != PhaseRequestHeaders {
+		return timeout
+	}
+
+	ms, err := strconv.ParseUint(getHeader(in.Headers, cfg.TimeoutHeader), 10, 32)
+	if err != nil || ms == 0 {
+		return timeout
+	}
+	timeout = time.Duration(ms) * time.Millisecond
+	if cfg.MaxDecisionTimeout > 0 && timeout > cfg.MaxDecisionTimeout {
+		timeout = cfg.MaxDecisionTimeout
+	}
+	return timeout
+}
+
+// decisionInput builds the Decider input for the evaluated phases, or returns
+// nil for phases the policy doesn't look at.
+func decisionInput(cfg *Config, req *extProcPb.ProcessingRequest) *DecisionInput {
+	in := &DecisionInput{
+		Config:     cfg,
+		Attributes: req.Attributes,
+	}
+	in.UpstreamIP, in.UpstreamSource = extractUpstreamAddress(cfg, req.Attributes)
+	in.UpstreamCluster = extractUpstreamCluster(cfg, req.Attributes)
+	in.SNI = extractSNI(cfg, req.Attributes)
+	if geoIP != nil {
+		if ip, _, err := normalizeAddress(in.UpstreamIP); err == nil {
+			in.UpstreamCountry, in.UpstreamASN = geoIP.lookup(ip)
+		}
+	}
+
+	switch v := req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestHeaders:
+		in.Phase = PhaseRequestHeaders
+		in.Headers = v.RequestHeaders.Headers
+	case *extProcPb.ProcessingRequest_ResponseHeaders:
+		in.Phase = PhaseResponseHeaders
+		in.Headers = v.ResponseHeaders.Headers
+	default:
+		return nil
+	}
+	return in
+}
@@ -0,0 +1,85 @@
+package extproc
+
+import (
+	"testing"
+	"time"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+func TestSimulate(t *testing.T) {
+	base := useConfig(t, &Config{})
+	prevBlocks := recentBlocks
+	recentBlocks = newBlockRing(10)
+	t.Cleanup(func() { recentBlocks = prevBlocks })
+	prevDecisions := decisions.Load()
+
+	const secret = Secret("s3cret")
+	cfg := &Config{
+		BypassHeader: "x-bypass",
+		BypassSecret: secret,
+		FailureMode:  FailureModeOpen,
+		MaxRequests:  1,
+	}
+	token := SignBypass(secret, "internal.example", time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name   string
+		req    *extProcPb.ProcessingRequest
+		want   ReasonCode
+		status typev3.StatusCode
+	}{
+		{"blocked", requestHeaders("10.0.0.1:80"), ReasonPrivate, typev3.StatusCode_Forbidden},
+		{"allowed", requestHeaders("93.184.216.34:443"), ReasonAllowed, 0},
+		// The decision is the one behind the response, after the bypass.
+		{"bypassed", requestHeaders("10.0.0.1:80", ":authority", "internal.example", "x-bypass", token), ReasonBypassed, 0},
+		{"fail-open body", requestBody("abc", true), ReasonExtraction, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, d, err := Simulate(cfg, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.ReasonCode != tt.want {
+				t.Errorf("decision = %+v, want %s", d, tt.want)
+			}
+			if got := immediateStatus(resp); got != tt.status {
+				t.Errorf("response status = %v, want %v: %v", got, tt.status, resp)
+			}
+		})
+	}
+
+	if config != base {
+		t.Error("Simulate replaced the package config")
+	}
+	if blocks := recentBlocks.list(); len(blocks) != 0 {
+		t.Errorf("Simulate recorded blocks %+v, want none", blocks)
+	}
+	if decisions.Load() != prevDecisions {
+		t.Error("Simulate counted toward MaxRequests")
+	}
+}
+
+func TestEvaluateSharedConfig(t *testing.T) {
+	// Run with -race: an unvalidated config shared by concurrent calls must
+	// not be written to.
+	cfg := &Config{DeniedCIDRs: []string{"93.184.216.0/24"}}
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < 8; i++ {
+			t.Run("", func(t *testing.T) {
+				t.Parallel()
+				if d := Evaluate(cfg, requestHeaders("93.184.216.34:443")); d.ReasonCode != ReasonDeniedCIDR {
+					t.Errorf("Evaluate = %s, want %s", d.ReasonCode, ReasonDeniedCIDR)
+				}
+				if _, d, err := Simulate(cfg, requestHeaders("93.184.216.34:443")); err != nil || d.ReasonCode != ReasonDeniedCIDR {
+					t.Errorf("Simulate = %s, %v, want %s", d.ReasonCode, err, ReasonDeniedCIDR)
+				}
+			})
+		}
+	})
+	if cfg.compiled != nil {
+		t.Error("Evaluate validated the caller's config in place")
+	}
+}
@@ -0,0 +1,69 @@
+package extproc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Errors returned by the decision functions. runDeciders maps each one to a
+// blocking Decision in decisionForError.
+var (
+	// ErrExtraction means the upstream address attribute was missing.
+	ErrExtraction = errors.New("unable to extract upstream IP address")
+	// ErrAttributesMissing means Envoy sent no ext_proc attributes at all.
+	ErrAttributesMissing = errors.New("ext_proc attributes are missing")
+	// ErrInvalidAddress means the upstream address attribute didn't parse.
+	ErrInvalidAddress = errors.New("invalid IP address")
+	// ErrReverseLookup means the reverse DNS lookup of the upstream IP failed
+	// with Config.ReverseLookupFailClosed set.
+	ErrReverseLookup = errors.New("reverse lookup failed")
+	// ErrChecksSaturated means Config.MaxConcurrentChecks checks were
+	// running and none finished before the decision had to be made.
+	ErrChecksSaturated = errors.New("too many concurrent checks")
+	// ErrNoVerdict means no Decider in the chain reached a verdict.
+	ErrNoVerdict = errors.New("no decider reached a verdict")
+	// ErrInconclusive is returned by a Decider that can't decide on the body
+	// it was given, e.g. a partially buffered one. Config.InconclusiveBody
+	// applies.
+	ErrInconclusive = errors.New("body decision is inconclusive")
+)
+
+// decisionForError maps a decision error to the Decision sent for it, so the
+// status code and reason category for each failure are defined in one place.
+func decisionForError(err error) Decision {
+	var d Decision
+	switch {
+	case errors.Is(err, ErrAttributesMissing):
+		d = blocked(ReasonAttributesMissing, err.Error(), "")
+	case errors.Is(err, ErrExtraction):
+		d = blocked(ReasonExtraction, err.Error(), "")
+	case errors.Is(err, ErrInvalidAddress):
+		d = blocked(ReasonInvalidAddress, err.Error(), "")
+	case errors.Is(err, ErrReverseLookup):
+		d = blocked(ReasonReverseLookup, err.Error(), "")
+	case errors.Is(err, ErrChecksSaturated):
+		d = blocked(ReasonChecksSaturated, err.Error(), "")
+		d.StatusCode = http.StatusServiceUnavailable
+	case errors.Is(err, ErrNoVerdict):
+		d = blocked(ReasonNoVerdict, err.Error(), "")
+	case errors.Is(err, ErrInconclusive):
+		d = blocked(ReasonInconclusiveBody, err.Error(), "")
+	case errors.Is(err, context.DeadlineExceeded):
+		d = blocked(ReasonDecisionTimeout, "decision timed out", "")
+		d.StatusCode = http.StatusGatewayTimeout
+	default:
+		d = blocked(ReasonDeciderError, err.Error(), "")
+	}
+	decisionErrorsTotal.WithLabelValues(string(d.ReasonCode)).Inc()
+	return d
+}
+
+// failOpen allows a request that couldn't be checked. It always warns and
+// counts in extproc_failopen_total so an operator can alert when the
+// processor isn't enforcing.
+func failOpen(code ReasonCode, text string) Decision {
+	failOpenTotal.WithLabelValues(string(code)).Inc()
+	log.Warnf("ALLOWED without upstream check (fail-open): %s", text)
+	return Decision{Allow: true, ReasonCode: code, ReasonText: text}
+}
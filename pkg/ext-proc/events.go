@@ -0,0 +1,188 @@
+package extproc
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultEventSinkSubject = "extproc.decisions"
+	defaultEventSinkBuffer  = 1024
+)
+
+// EventSink receives decision events. Send may block; the processor always
+// calls it from a background goroutine, never from the request path.
+type EventSink interface {
+	Send(Event) error
+	Close() error
+}
+
+// asyncSink queues events for an EventSink in a bounded buffer and drops them
+// when it's full, so a slow or unavailable sink never delays a decision. A nil
+// *asyncSink discards events.
+type asyncSink struct {
+	sink  EventSink
+	queue chan Event
+	done  sync.WaitGroup
+	once  sync.Once
+}
+
+func newAsyncSink(sink EventSink, size int) *asyncSink {
+	if size <= 0 {
+		size = defaultEventSinkBuffer
+	}
+	a := &asyncSink{sink: sink, queue: make(chan Event, size)}
+	a.done.Add(1)
+	go a.run()
+	return a
+}
+
+func (a *asyncSink) run() {
+	defer a.done.Done()
+	for e := range a.queue {
+		if err := a.sink.Send(e); err != nil {
+			eventsDroppedTotal.WithLabelValues("error").Inc()
+			log.Debugf("event sink error %v", err)
+		}
+	}
+}
+
+// send queues an event without blocking.
+func (a *asyncSink) send(e Event) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.queue <- e:
+	default:
+		eventsDroppedTotal.WithLabelValues("overflow").Inc()
+	}
+}
+
+// close sends the queued events and closes the sink. No events may be sent
+// after it is called.
+func (a *asyncSink) close() {
+	if a == nil {
+		return
+	}
+	a.once.Do(func() {
+		close(a.queue)
+		a.done.Wait()
+		if err := a.sink.Close(); err != nil {
+			log.Errorf("event sink close error %v", err)
+		}
+	})
+}
+
+// prober returns the sink's prober, if it has one.
+func (a *asyncSink) prober() (prober, bool) {
+	if a == nil {
+		return nil, false
+	}
+	p, ok := a.sink.(prober)
+	return p, ok
+}
+
+// openEventSink returns the async sink for the configured EventSink or
+// EventSinkURL, or nil when neither is set.
+func openEventSink(c *Config) (*asyncSink, error) {
+	sink := c.EventSink
+	if sink == nil && c.EventSinkURL != "" {
+		var err error
+		if sink, err = newURLSink(c.EventSinkURL, c.EventSinkSubject, c.AuditFormat); err != nil {
+			return nil, err
+		}
+	}
+	if sink == nil {
+		return nil, nil
+	}
+	return newAsyncSink(sink, c.EventSinkBuffer), nil
+}
+
+// newURLSink builds the built-in sink for the URL's scheme.
+func newURLSink(rawURL, subject, format string) (EventSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event sink URL: %w", err)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+		return newNATSSink(rawURL, subject, format)
+	default:
+		return nil, fmt.Errorf("unsupported event sink scheme %q", u.Scheme)
+	}
+}
+
+// redactURL hides the userinfo of a URL, which may hold credentials. A URL
+// that doesn't parse is hidden entirely.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedValue
+	}
+	if u.User == nil {
+		return rawURL
+	}
+	// url.User would percent-encode the placeholder, so splice it in.
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//"+redactedValue+"@", 1)
+}
+
+// natsSink publishes events to a NATS subject, one record per message.
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+	format  string
+}
+
+func newNATSSink(rawURL, subject, format string) (*natsSink, error) {
+	if subject == "" {
+		subject = defaultEventSinkSubject
+	}
+	// Keep reconnecting for as long as the process runs; events published
+	// while disconnected are buffered by the client up to its own limit.
+	conn, err := nats.Connect(rawURL,
+		nats.Name("extprocdemo"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("event sink connect: %w", err)
+	}
+	return &natsSink{conn: conn, subject: subject, format: format}, nil
+}
+
+// Send implements EventSink.
+func (s *natsSink) Send(e Event) error {
+	data, err := formatEvent(s.format, e)
+	if err != nil {
+		return err
+	}
+	return s.conn.Publish(s.subject, data)
+}
+
+// Close implements EventSink.
+func (s *natsSink) Close() error {
+	return s.conn.Drain()
+}
+
+// Probe implements prober. It waits for the connection to the server, which
+// is made in the background.
+func (s *natsSink) Probe(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !s.conn.IsConnected() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not connected: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package extproc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Event record formats for the audit log and built-in event sinks.
+const (
+	AuditFormatJSON = "json"
+	AuditFormatCEF  = "cef"
+	AuditFormatLEEF = "leef"
+)
+
+const (
+	eventVendor  = "bladedancer"
+	eventProduct = "extprocdemo"
+	eventVersion = "1"
+)
+
+// Severities reported in CEF and LEEF records, on their shared 0-10 scale.
+const (
+	severityBlocked = 7
+	severityAllowed = 1
+)
+
+// formatEvent renders an event as a single line in the given format. The
+// forensic Headers dump is only carried by JSON.
+func formatEvent(format string, e Event) ([]byte, error) {
+	switch format {
+	case "", AuditFormatJSON:
+		return json.Marshal(e)
+	case AuditFormatCEF:
+		return []byte(formatCEF(e)), nil
+	case AuditFormatLEEF:
+		return []byte(formatLEEF(e)), nil
+	default:
+		return nil, fmt.Errorf("invalid audit format %q", format)
+	}
+}
+
+// eventFields returns the action, severity, destination IP and port of an
+// event. The port is empty when the upstream address doesn't carry one.
+func eventFields(e Event) (action string, severity int, dst, dpt string) {
+	action, severity = "blocked", severityBlocked
+	if e.Allowed {
+		action, severity = "allowed", severityAllowed
+	}
+	dst = e.UpstreamIP
+	if ip, port, err := normalizeAddress(e.UpstreamIP); err == nil {
+		dst = ip.String()
+		if port != 0 {
+			dpt = strconv.Itoa(port)
+		}
+	}
+	return action, severity, dst, dpt
+}
+
+// formatCEF renders an event as an ArcSight Common Event Format record.
+func formatCEF(e Event) string {
+	action, severity, dst, dpt := eventFields(e)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeader(eventVendor), cefHeader(eventProduct), cefHeader(eventVersion),
+		cefHeader(string(e.ReasonCode)), cefHeader("Upstream "+action), severity)
+
+	ext := []string{
+		"rt=" + strconv.FormatInt(e.Time.UnixMilli(), 10),
+		"act=" + action,
+	}
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExtension(value))
+		}
+	}
+	add("dst", dst)
+	add("dpt", dpt)
+	add("dhost", e.Authority)
+	add("reason", e.Reason)
+	if e.MatchedRule != "" {
+		add("cs1Label", "matchedRule")
+		add("cs1", e.MatchedRule)
+	}
+	if e.RequestID != "" {
+		add("cs2Label", "requestId")
+		add("cs2", e.RequestID)
+	}
+	b.WriteString(strings.Join(ext, " "))
+	return b.String()
+}
+
+// cefHeader escapes a CEF header field.
+func cefHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "|", `\|`, "\n", " ", "\r", " ").Replace(s)
+}
+
+// cefExtension escapes a CEF extension value.
+func cefExtension(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// formatLEEF renders an event as an IBM QRadar LEEF 1.0 record.
+func formatLEEF(e Event) string {
+	action, severity, dst, dpt := eventFields(e)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|",
+		leefHeader(eventVendor), leefHeader(eventProduct), leefHeader(eventVersion), leefHeader(string(e.ReasonCode)))
+
+	attrs := []string{
+		// Epoch milliseconds need no devTimeFormat.
+		"devTime=" + strconv.FormatInt(e.Time.UnixMilli(), 10),
+		"cat=" + action,
+		"sev=" + strconv.Itoa(severity),
+	}
+	add := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, key+"="+leefAttribute(value))
+		}
+	}
+	add("dst", dst)
+	add("dstPort", dpt)
+	add("host", e.Authority)
+	add("reason", e.Reason)
+	add("matchedRule", e.MatchedRule)
+	add("requestId", e.RequestID)
+	b.WriteString(strings.Join(attrs, "\t"))
+	return b.String()
+}
+
+// leefHeader escapes a LEEF header field.
+func leefHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "|", `\|`, "\n", " ", "\r", " ").Replace(s)
+}
+
+// leefAttribute makes a value safe between LEEF's tab delimiters.
+func leefAttribute(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(s)
+}
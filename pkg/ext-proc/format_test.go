@@ -0,0 +1,82 @@
+package extproc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatEvent(t *testing.T) {
+	blockedEvent := Event{
+		Time:        time.UnixMilli(1700000000123),
+		UpstreamIP:  "[2001:db8::1]:8443",
+		ReasonCode:  ReasonDeniedCIDR,
+		Reason:      "a=b\\c\nd\te",
+		MatchedRule: "10.0.0.0/8",
+		RequestID:   "req|1",
+		Authority:   "api.example.com",
+		Headers:     map[string]string{"x-secret": "kept out"},
+	}
+	allowedEvent := Event{
+		Time:       time.UnixMilli(1700000000123),
+		Allowed:    true,
+		UpstreamIP: "93.184.216.34",
+		ReasonCode: ReasonAllowed,
+	}
+
+	tests := []struct {
+		format string
+		event  Event
+		want   string
+	}{
+		{
+			AuditFormatCEF, blockedEvent,
+			`CEF:0|bladedancer|extprocdemo|1|DENIED_CIDR|Upstream blocked|7|rt=1700000000123 act=blocked dst=2001:db8::1 dpt=8443 dhost=api.example.com reason=a\=b\\c\nd` + "\t" + `e cs1Label=matchedRule cs1=10.0.0.0/8 cs2Label=requestId cs2=req|1`,
+		},
+		{
+			AuditFormatCEF, allowedEvent,
+			`CEF:0|bladedancer|extprocdemo|1|ALLOWED|Upstream allowed|1|rt=1700000000123 act=allowed dst=93.184.216.34`,
+		},
+		{
+			AuditFormatLEEF, blockedEvent,
+			"LEEF:1.0|bladedancer|extprocdemo|1|DENIED_CIDR|devTime=1700000000123\tcat=blocked\tsev=7\tdst=2001:db8::1\tdstPort=8443\thost=api.example.com\treason=a=b\\c d e\tmatchedRule=10.0.0.0/8\trequestId=req|1",
+		},
+		{
+			AuditFormatLEEF, allowedEvent,
+			"LEEF:1.0|bladedancer|extprocdemo|1|ALLOWED|devTime=1700000000123\tcat=allowed\tsev=1\tdst=93.184.216.34",
+		},
+	}
+	for _, tt := range tests {
+		got, err := formatEvent(tt.format, tt.event)
+		if err != nil {
+			t.Fatalf("formatEvent(%s) = %v", tt.format, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("formatEvent(%s) =\n%s\nwant\n%s", tt.format, got, tt.want)
+		}
+	}
+
+	if _, err := formatEvent("syslog", blockedEvent); err == nil {
+		t.Error("formatEvent(syslog) succeeded, want an error")
+	}
+}
+
+func TestFormatEventHeaderEscaping(t *testing.T) {
+	e := Event{Time: time.UnixMilli(0), UpstreamIP: "not-an-ip", ReasonCode: ReasonCode("BAD|CODE\\X\nY\rZ")}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{AuditFormatCEF, `CEF:0|bladedancer|extprocdemo|1|BAD\|CODE\\X Y Z|Upstream blocked|7|rt=0 act=blocked dst=not-an-ip`},
+		{AuditFormatLEEF, "LEEF:1.0|bladedancer|extprocdemo|1|BAD\\|CODE\\\\X Y Z|devTime=0\tcat=blocked\tsev=7\tdst=not-an-ip"},
+	}
+	for _, tt := range tests {
+		got, err := formatEvent(tt.format, e)
+		if err != nil {
+			t.Fatalf("formatEvent(%s) = %v", tt.format, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("formatEvent(%s) =\n%s\nwant\n%s", tt.format, got, tt.want)
+		}
+	}
+}
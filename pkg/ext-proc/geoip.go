@@ -0,0 +1,84 @@
+package extproc
+
+import (
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoRecord holds the fields read from a MaxMind format database. Country
+// databases fill Country and ASN databases fill the autonomous system, so
+// either kind works and a combined one fills both.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// geoIPDB looks up upstream IPs in a MaxMind format database. It is safe for
+// concurrent use, and a nil *geoIPDB finds nothing.
+type geoIPDB struct {
+	mu     sync.RWMutex
+	path   string
+	reader *maxminddb.Reader
+}
+
+func openGeoIPDB(path string) (*geoIPDB, error) {
+	if path == "" {
+		return nil, nil
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIPDB{path: path, reader: reader}, nil
+}
+
+// lookup returns the ISO country code and ASN of ip, empty or zero when the
+// database has no entry.
+func (g *geoIPDB) lookup(ip net.IP) (string, uint) {
+	if g == nil {
+		return "", 0
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var rec geoRecord
+	if err := g.reader.Lookup(ip, &rec); err != nil {
+		log.Debugf("GeoIP lookup of %s failed: %v", ip, err)
+		return "", 0
+	}
+	return rec.Country.ISOCode, rec.ASN
+}
+
+// reopen loads the database again so an updated file is picked up. The old
+// one stays in use if the new one can't be opened.
+func (g *geoIPDB) reopen() {
+	if g == nil {
+		return
+	}
+	reader, err := maxminddb.Open(g.path)
+	if err != nil {
+		log.Errorf("GeoIP database reopen error %v", err)
+		return
+	}
+
+	g.mu.Lock()
+	old := g.reader
+	g.reader = reader
+	g.mu.Unlock()
+	old.Close()
+	log.Infof("Reopened GeoIP database %s", g.path)
+}
+
+// close closes the database.
+func (g *geoIPDB) close() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.reader.Close()
+}
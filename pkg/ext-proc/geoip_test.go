@@ -0,0 +1,25 @@
+package extproc
+
+import "testing"
+
+func TestGeoIPDenyListsNeedDatabase(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *Config
+		wantErr bool
+	}{
+		{"none", &Config{}, false},
+		{"countries", &Config{DeniedCountries: []string{"KP"}}, true},
+		{"asns", &Config{DeniedASNs: []uint{64512}}, true},
+		{"database only", &Config{GeoIPDBPath: "/data/GeoLite2-Country.mmdb"}, false},
+		{"countries with database", &Config{GeoIPDBPath: "/data/GeoLite2-Country.mmdb", DeniedCountries: []string{"KP"}}, false},
+		{"asns with database", &Config{GeoIPDBPath: "/data/GeoLite2-ASN.mmdb", DeniedASNs: []uint{64512}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package extproc
+
+import (
+	"crypto/rand"
+	"fmt"
+	"mime"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// getHeader returns the value of the named header, or "" when absent. Envoy
+// may populate either Value or RawValue depending on its configuration.
+func getHeader(headers *corev3.HeaderMap, name string) string {
+	if headers == nil {
+		return ""
+	}
+	for _, h := range headers.Headers {
+		if strings.EqualFold(h.Key, name) {
+			if h.Value != "" {
+				return h.Value
+			}
+			return string(h.RawValue)
+		}
+	}
+	return ""
+}
+
+// defaultRequestIDHeader is the request id header when
+// Config.RequestIDHeader is empty.
+const defaultRequestIDHeader = "x-request-id"
+
+// requestIDHeader is the header decisions are correlated by.
+func requestIDHeader(cfg *Config) string {
+	if cfg.RequestIDHeader != "" {
+		return strings.ToLower(cfg.RequestIDHeader)
+	}
+	return defaultRequestIDHeader
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// isGrpcRequest reports whether the request headers describe a gRPC call.
+func isGrpcRequest(headers *corev3.HeaderMap) bool {
+	return strings.HasPrefix(mediaType(getHeader(headers, "content-type")), "application/grpc")
+}
+
+// mediaType returns the lower-cased type/subtype of a content-type value,
+// dropping any parameters.
+func mediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt, _, _ = strings.Cut(contentType, ";")
+	}
+	return strings.ToLower(strings.TrimSpace(mt))
+}
+
+// markerHeaders returns the lower-cased names of the configured headers that
+// carry signed tokens for this processor. Their values are never logged and
+// they are removed from requests before they are forwarded upstream.
+func (c *Config) markerHeaders() []string {
+	var names []string
+	for _, h := range []string{c.TrustedValidationHeader, c.BypassHeader} {
+		if h != "" {
+			names = append(names, strings.ToLower(h))
+		}
+	}
+	return names
+}
+
+// presentMarkerHeaders returns the marker headers present in headers.
+func presentMarkerHeaders(cfg *Config, headers *corev3.HeaderMap) []string {
+	var present []string
+	for _, name := range cfg.markerHeaders() {
+		if hasHeader(headers, name) {
+			present = append(present, name)
+		}
+	}
+	return present
+}
+
+// hasHeader reports whether headers has the named header, even if empty.
+func hasHeader(headers *corev3.HeaderMap, name string) bool {
+	if headers == nil {
+		return false
+	}
+	for _, h := range headers.Headers {
+		if strings.EqualFold(h.Key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+const redactedValue = "***"
+
+// redactedHeaders flattens the header map for logging, replacing the values of
+// any header listed in Config.RedactHeaders.
+func redactedHeaders(cfg *Config, headers *corev3.HeaderMap) map[string]string {
+	out := map[string]string{}
+	if headers == nil {
+		return out
+	}
+	for _, h := range headers.Headers {
+		key := strings.ToLower(h.Key)
+		if cfg.compiled.redactHeaders[key] {
+			out[key] = redactedValue
+			continue
+		}
+		if h.Value != "" {
+			out[key] = h.Value
+		} else {
+			out[key] = string(h.RawValue)
+		}
+	}
+	return out
+}
@@ -0,0 +1,91 @@
+package extproc
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// hostMatcher matches hostnames against a set of patterns compiled once at
+// startup. Exact names use a map, "*.suffix" patterns a suffix check, and any
+// other wildcard an anchored regexp.
+type hostMatcher struct {
+	exact    map[string]string
+	suffixes []string
+	patterns []*regexp.Regexp
+	// suffixSources and patternSources are the configured patterns behind
+	// suffixes and patterns, index for index.
+	suffixSources  []string
+	patternSources []string
+}
+
+// compileHostPatterns builds a hostMatcher. A "*" matches any run of
+// characters, including dots; matching is case-insensitive.
+func compileHostPatterns(patterns []string) (*hostMatcher, error) {
+	m := &hostMatcher{exact: map[string]string{}}
+	for _, p := range patterns {
+		pattern := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(p), "."))
+		if err := validateHostPattern(pattern); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", p, err)
+		}
+
+		switch {
+		case !strings.Contains(pattern, "*"):
+			m.exact[pattern] = p
+		case strings.HasPrefix(pattern, "*.") && !strings.Contains(pattern[2:], "*"):
+			m.suffixes = append(m.suffixes, pattern[1:])
+			m.suffixSources = append(m.suffixSources, p)
+		default:
+			expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+			m.patterns = append(m.patterns, regexp.MustCompile(expr))
+			m.patternSources = append(m.patternSources, p)
+		}
+	}
+	return m, nil
+}
+
+func validateHostPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	for _, r := range pattern {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.', r == '_', r == '*':
+		default:
+			return fmt.Errorf("unsupported character %q", r)
+		}
+	}
+	return nil
+}
+
+// match returns the pattern that matches host, or "" when none does.
+func (m *hostMatcher) match(host string) string {
+	if m == nil || host == "" {
+		return ""
+	}
+	host = normalizeHost(host)
+	if p, ok := m.exact[host]; ok {
+		return p
+	}
+	for i, suffix := range m.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return m.suffixSources[i]
+		}
+	}
+	for i, re := range m.patterns {
+		if re.MatchString(host) {
+			return m.patternSources[i]
+		}
+	}
+	return ""
+}
+
+// normalizeHost lower-cases an authority and strips any port and trailing dot.
+func normalizeHost(authority string) string {
+	host := authority
+	if h, _, err := net.SplitHostPort(authority); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
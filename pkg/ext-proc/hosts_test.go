@@ -0,0 +1,41 @@
+package extproc
+
+import (
+	"testing"
+)
+
+func TestHostMatcher(t *testing.T) {
+	m, err := compileHostPatterns([]string{"10-*.internal", "*.svc.cluster.local", "Metadata.Google.Internal."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"a.svc.cluster.local", "*.svc.cluster.local"},
+		{"a.b.svc.cluster.local:8080", "*.svc.cluster.local"},
+		{"svc.cluster.local", ""},
+		{"10-0-0-1.internal", "10-*.internal"},
+		{"10-.internal", "10-*.internal"},
+		{"11-0-0-1.internal", ""},
+		{"metadata.google.internal", "Metadata.Google.Internal."},
+		{"METADATA.google.internal.:80", "Metadata.Google.Internal."},
+		{"example.com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := m.match(tt.host); got != tt.want {
+			t.Errorf("match(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCompileHostPatternsInvalid(t *testing.T) {
+	for _, p := range []string{"", "exa mple.com", "host/path", "[::1]"} {
+		if _, err := compileHostPatterns([]string{p}); err == nil {
+			t.Errorf("compileHostPatterns(%q) succeeded, want an error", p)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package extproc
+
+import (
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// recoverStream turns a panic in a stream handler, including user supplied
+// Deciders, into a codes.Internal error for that stream instead of crashing
+// the process.
+func recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicsTotal.Inc()
+			log.WithField("method", info.FullMethod).Errorf("Recovered panic: %v\n%s", r, debug.Stack())
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// inFlightStreams counts the streams being handled for Config.MaxStreams.
+var inFlightStreams atomic.Int64
+
+// limitStreams rejects a stream while Config.MaxStreams are already in flight,
+// so Envoy retries or fails over instead of queueing. Only ext_proc streams
+// count, health watches and reflection are never rejected.
+func limitStreams(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if info.FullMethod != extProcPb.ExternalProcessor_Process_FullMethodName {
+		return handler(srv, ss)
+	}
+	n := inFlightStreams.Add(1)
+	defer func() {
+		inFlightStreams.Add(-1)
+		inFlightStreamsGauge.Dec()
+	}()
+	inFlightStreamsGauge.Inc()
+
+	if config.MaxStreams > 0 && n > int64(config.MaxStreams) {
+		streamsRejectedTotal.Inc()
+		return overloaded(ss)
+	}
+	return handler(srv, ss)
+}
+
+// overloaded ends a stream rejected for overload per Config.OverloadResponse.
+// A gRPC error lets Envoy apply its failure_mode_allow setting; an immediate
+// response answers the first message with Config.OverloadStatusCode instead.
+func overloaded(ss grpc.ServerStream) error {
+	if config.OverloadResponse != OverloadImmediateResponse {
+		if config.OverloadRetryAfter != "" {
+			ss.SetTrailer(metadata.Pairs("retry-after", config.OverloadRetryAfter))
+		}
+		return status.Error(codes.Unavailable, "too many streams in flight")
+	}
+
+	req := &extProcPb.ProcessingRequest{}
+	if err := ss.RecvMsg(req); err != nil {
+		return nil
+	}
+	code := config.OverloadStatusCode
+	if code == 0 {
+		code = http.StatusServiceUnavailable
+	}
+	decision := blocked(ReasonOverloaded, "processor overloaded", "")
+	decision.StatusCode = code
+	resp := blockResponse(activeConfig(), nil, decision, isGrpcRequest(req.GetRequestHeaders().GetHeaders()))
+	if config.OverloadRetryAfter != "" {
+		immediate := resp.GetImmediateResponse()
+		immediate.Headers.SetHeaders = append(immediate.Headers.SetHeaders, setHeader("retry-after", config.OverloadRetryAfter))
+	}
+	return ss.SendMsg(resp)
+}
@@ -0,0 +1,50 @@
+package extproc
+
+import (
+	"context"
+	"testing"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLimitStreamsOnlyProcess(t *testing.T) {
+	useConfig(t, &Config{MaxStreams: 1})
+	ss := newFakeProcessStream(context.Background())
+	info := func(method string) *grpc.StreamServerInfo {
+		return &grpc.StreamServerInfo{FullMethod: method, IsServerStream: true}
+	}
+
+	var ran []string
+	handler := func(name string) grpc.StreamHandler {
+		return func(srv interface{}, stream grpc.ServerStream) error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+
+	// With one ext_proc stream in flight, a second is rejected but health
+	// watches and reflection still go through.
+	err := limitStreams(nil, ss, info(extProcPb.ExternalProcessor_Process_FullMethodName), func(srv interface{}, stream grpc.ServerStream) error {
+		if err := limitStreams(nil, ss, info(extProcPb.ExternalProcessor_Process_FullMethodName), handler("process")); status.Code(err) != codes.Unavailable {
+			t.Errorf("second Process stream = %v, want %s", err, codes.Unavailable)
+		}
+		for _, method := range []string{"/grpc.health.v1.Health/Watch", "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"} {
+			if err := limitStreams(nil, ss, info(method), handler(method)); err != nil {
+				t.Errorf("%s = %v, want nil", method, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("first Process stream = %v", err)
+	}
+	if len(ran) != 2 || ran[0] != "/grpc.health.v1.Health/Watch" {
+		t.Errorf("handlers run = %v, want the health watch and reflection only", ran)
+	}
+	if n := inFlightStreams.Load(); n != 0 {
+		t.Errorf("in flight streams = %d after all ended, want 0", n)
+	}
+}
@@ -0,0 +1,195 @@
+package extproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Config.Listen address schemes.
+const (
+	unixScheme = "unix://"
+	tcpScheme  = "tcp://"
+)
+
+// defaultSocketMode is the unix socket permission when Config.SocketMode is
+// zero.
+const defaultSocketMode os.FileMode = 0o660
+
+// isWildcardAddress reports whether addr binds every interface.
+func isWildcardAddress(addr string) bool {
+	if addr == "" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// validateNetwork checks Config.Network against the bind address and dual
+// stack settings.
+func validateNetwork(c *Config) error {
+	// With SO_REUSEPORT the IPv4 bind would succeed next to a dual-stack
+	// socket that already accepts IPv4, so listen couldn't tell whether it
+	// needs one.
+	if c.DualStack && c.ReusePort {
+		return fmt.Errorf("dual stack can't be used with reuse port")
+	}
+	switch c.Network {
+	case "", "tcp":
+		return nil
+	case "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid network %q, expected tcp, tcp4 or tcp6", c.Network)
+	}
+
+	if c.DualStack {
+		return fmt.Errorf("dual stack requires network tcp, got %q", c.Network)
+	}
+	ip := net.ParseIP(c.BindAddress)
+	if ip == nil {
+		// A hostname, resolved in the chosen family by Listen.
+		return nil
+	}
+	if isIPv4 := ip.To4() != nil; isIPv4 != (c.Network == "tcp4") {
+		return fmt.Errorf("bind address %s can't be used with network %s", c.BindAddress, c.Network)
+	}
+	return nil
+}
+
+// validateListen checks Config.Listen.
+func validateListen(c *Config) error {
+	if c.Listen == "" {
+		return nil
+	}
+	if path, ok := strings.CutPrefix(c.Listen, unixScheme); ok {
+		if path == "" {
+			return fmt.Errorf("listen address %q has no socket path", c.Listen)
+		}
+		if c.DualStack || c.ReusePort {
+			return fmt.Errorf("dual stack and reuse port can't be used with a unix socket")
+		}
+		return nil
+	}
+	if addr, ok := strings.CutPrefix(c.Listen, tcpScheme); ok {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", c.Listen, err)
+		}
+		if c.DualStack {
+			return fmt.Errorf("dual stack requires bindAddress and port instead of a listen address")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid listen address %q, expected unix:///path or tcp://host:port", c.Listen)
+}
+
+// listenUnix listens on a unix socket at path, replacing a stale socket left
+// by an earlier run. The socket file is removed when the listener closes.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode := config.SocketMode
+	if mode == 0 {
+		mode = defaultSocketMode
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
+
+// listenNetwork is the network for a single listener.
+func listenNetwork() string {
+	if config.Network == "" {
+		return "tcp"
+	}
+	return config.Network
+}
+
+// listenConfig returns the ListenConfig for the gRPC listeners. The accept
+// backlog isn't settable from Go, it follows the OS default
+// (net.core.somaxconn on Linux).
+func listenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{}
+	if config.ReusePort {
+		if reusePortSupported {
+			lc.Control = setReusePort
+		} else {
+			log.Warn("SO_REUSEPORT isn't supported on this platform, ignoring reusePort")
+		}
+	}
+	return lc
+}
+
+// listen opens the gRPC listeners for Config.Listen, or the bind address and
+// port when it's empty.
+func listen() ([]net.Listener, error) {
+	if path, ok := strings.CutPrefix(config.Listen, unixScheme); ok {
+		lis, err := listenUnix(path)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lis}, nil
+	}
+
+	port := strconv.Itoa(int(config.Port))
+	lc := listenConfig()
+	ctx := context.Background()
+
+	if addr, ok := strings.CutPrefix(config.Listen, tcpScheme); ok {
+		lis, err := lc.Listen(ctx, listenNetwork(), addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lis}, nil
+	}
+
+	if !config.DualStack {
+		lis, err := lc.Listen(ctx, listenNetwork(), net.JoinHostPort(config.BindAddress, port))
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lis}, nil
+	}
+
+	if !isWildcardAddress(config.BindAddress) {
+		return nil, fmt.Errorf("dual stack requires a wildcard bind address, got %q", config.BindAddress)
+	}
+
+	// Go disables IPV6_V6ONLY for wildcard "tcp" listeners, so [::] normally
+	// accepts both families. If the OS doesn't map IPv4 onto that socket the
+	// IPv4 port is still free and we add a second listener for it. Port 0
+	// picks the same port for both.
+	lis6, err := lc.Listen(ctx, "tcp", net.JoinHostPort("::", port))
+	if err != nil {
+		return nil, err
+	}
+	port = strconv.Itoa(lis6.Addr().(*net.TCPAddr).Port)
+
+	lis4, err := lc.Listen(ctx, "tcp4", net.JoinHostPort("0.0.0.0", port))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		// Port already held by the dual-stack socket.
+		return []net.Listener{lis6}, nil
+	} else if err != nil {
+		lis6.Close()
+		return nil, err
+	}
+	log.Info("IPv4-mapped IPv6 not supported, listening on separate IPv4 and IPv6 sockets")
+	return []net.Listener{lis6, lis4}, nil
+}
@@ -0,0 +1,47 @@
+package extproc
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestDualStackReusePortRejected(t *testing.T) {
+	cfg := &Config{DualStack: true, ReusePort: true}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() accepted dual stack with reuse port")
+	}
+}
+
+func TestListenDualStack(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6: %v", err)
+	} else {
+		l.Close()
+	}
+	useConfig(t, &Config{DualStack: true})
+
+	listeners, err := listen()
+	if err != nil {
+		t.Fatalf("listen() = %v", err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	// However the OS maps IPv4, every listener is on the one port and an
+	// IPv4 client gets through.
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+	for _, l := range listeners[1:] {
+		if got := l.Addr().(*net.TCPAddr).Port; got != port {
+			t.Errorf("listener on port %d, want %d", got, port)
+		}
+	}
+	conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("IPv4 dial = %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,114 @@
+package extproc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	panicsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "extproc_panics_total",
+		Help: "Number of panics recovered while processing a stream.",
+	})
+
+	streamResetsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "extproc_stream_resets_total",
+		Help: "Number of streams cancelled or reset by the client.",
+	})
+
+	inFlightStreamsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "extproc_streams_in_flight",
+		Help: "Number of streams currently open, including ones being rejected.",
+	})
+
+	streamsRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "extproc_streams_rejected_total",
+		Help: "Number of streams rejected because MaxStreams were in flight.",
+	})
+
+	throttledStreamsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "extproc_streams_throttled_total",
+		Help: "Number of streams slowed down by the per-stream message rate.",
+	})
+
+	reverseLookupCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_reverse_lookup_cache_total",
+		Help: "Number of reverse DNS lookups by cache result: hit, miss or shared with a lookup in flight.",
+	}, []string{"result"})
+
+	resolveDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "extproc_resolve_duration_seconds",
+		Help:    "Duration of reverse DNS lookups by outcome: ok, timeout or error.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"outcome"})
+
+	reverseLookupsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "extproc_reverse_lookups_in_flight",
+		Help: "Number of reverse DNS queries currently running.",
+	})
+
+	checksWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "extproc_checks_waiting",
+		Help: "Number of decisions waiting for a slot because MaxConcurrentChecks checks were running.",
+	})
+
+	checksRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "extproc_checks_rejected_total",
+		Help: "Number of checks that gave up waiting for a slot because MaxConcurrentChecks checks were running.",
+	})
+
+	bypassTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_bypass_total",
+		Help: "Number of bypass tokens seen, by result: bypassed, invalid or expired.",
+	}, []string{"result"})
+
+	policyReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_policy_reloads_total",
+		Help: "Number of policy file reloads, by result: success or error.",
+	}, []string{"result"})
+
+	clientCertsRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "extproc_client_certs_rejected_total",
+		Help: "Number of TLS handshakes rejected because the client certificate had no allowed SAN.",
+	})
+
+	decisionErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_decision_errors_total",
+		Help: "Number of decisions that failed with an error, by reason code.",
+	}, []string{"reason"})
+
+	phaseTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_phase_total",
+		Help: "Number of processing messages received, by phase.",
+	}, []string{"phase"})
+
+	invalidAddressTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_invalid_address_total",
+		Help: "Number of upstream addresses that didn't parse, by action taken.",
+	}, []string{"action"})
+
+	bodyChunkLimitTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_body_chunk_limit_total",
+		Help: "Number of streams that exceeded the body chunk limit, by action taken.",
+	}, []string{"action"})
+
+	inconclusiveBodyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_inconclusive_body_total",
+		Help: "Number of body decisions that couldn't be completed, by action taken.",
+	}, []string{"action"})
+
+	bodyReplacementsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_body_replacements_total",
+		Help: "Number of response bodies replaced by a BodyInspector, by buffered or streamed mode.",
+	}, []string{"mode"})
+
+	eventsDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_events_dropped_total",
+		Help: "Number of decision events not delivered to the event sink, by cause.",
+	}, []string{"cause"})
+
+	failOpenTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "extproc_failopen_total",
+		Help: "Number of requests allowed only because of fail-open, by reason code.",
+	}, []string{"reason"})
+)
@@ -4,14 +4,55 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var log logrus.FieldLogger
+var log logrus.FieldLogger = logrus.StandardLogger()
 var config *Config
+var recentBlocks *blockRing
+var audit *auditLog
+var events *asyncSink
+var workers *workerPool
+var geoIP *geoIPDB
+var policy *fileWatcher
+var certs *serverCerts
 
 // Init initializes the base resources.
-func Init(logger *logrus.Logger, c *Config) {
+func Init(logger *logrus.Logger, c *Config) error {
 	log = logger.WithField("package", "extproc")
+	if err := c.Validate(); err != nil {
+		return err
+	}
 	config = c
-	log.Infof("Base config: %+v", config)
+	recentBlocks = newBlockRing(c.RecentBlocksSize)
+
+	var err error
+	if audit, err = openAuditLog(c.AuditLogFile, c.AuditFormat); err != nil {
+		return err
+	}
+	if events, err = openEventSink(c); err != nil {
+		return err
+	}
+	if geoIP, err = openGeoIPDB(c.GeoIPDBPath); err != nil {
+		return err
+	}
+	if policy, err = watchPolicy(c); err != nil {
+		return err
+	}
+	if certs, err = openServerCerts(c); err != nil {
+		return err
+	}
+	workers = newWorkerPool(c.WorkerPoolSize)
+	if c.ProbeDependenciesOnStart {
+		if err := probeDependencies(c); err != nil && c.ProbeRequired {
+			return err
+		}
+	}
+	log.Infof("Base config: %+v", c.Redacted())
+	if c.AllowLoopback {
+		log.Warn("Loopback upstreams are allowed, this is intended for local development only")
+	}
+	if metadataServiceAllowed(c) {
+		log.Warn("Cloud metadata service upstreams are allowed, make sure it is only reachable through a hardened proxy")
+	}
+	return nil
 }
 
 // GetConfig returns the current config.
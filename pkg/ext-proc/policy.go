@@ -0,0 +1,134 @@
+package extproc
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is the part of the config that can be loaded from Config.PolicyFile
+// and reloaded while running. Fields left out of the file keep their values
+// from the rest of the config. The file is YAML, JSON also parses.
+type Policy struct {
+	AllowedCIDRs         []string `yaml:"allowedCIDRs"`
+	DeniedCIDRs          []string `yaml:"deniedCIDRs"`
+	AllowMetadataService *bool    `yaml:"allowMetadataService"`
+	BlockStatusCode      int      `yaml:"blockStatusCode"`
+	BlockBody            string   `yaml:"blockBody"`
+}
+
+// policyConfig is the config with the current policy file applied, nil when
+// there is no policy file.
+var policyConfig atomic.Pointer[Config]
+
+// activeConfig is the config decisions are evaluated against: the package
+// config with the current policy file applied. Settings the policy file
+// doesn't cover are the same in both.
+func activeConfig() *Config {
+	if c := policyConfig.Load(); c != nil {
+		return c
+	}
+	return config
+}
+
+// readPolicy parses the policy file at path, rejecting unknown fields.
+func readPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// applyPolicy returns a validated copy of base with p applied.
+func applyPolicy(base *Config, p *Policy) (*Config, error) {
+	c := *base
+	c.compiled = nil
+	if p.AllowedCIDRs != nil {
+		c.AllowedCIDRs = p.AllowedCIDRs
+	}
+	if p.DeniedCIDRs != nil {
+		c.DeniedCIDRs = p.DeniedCIDRs
+	}
+	if p.AllowMetadataService != nil {
+		c.AllowMetadataService = *p.AllowMetadataService
+	}
+	if p.BlockStatusCode != 0 {
+		c.BlockStatusCode = p.BlockStatusCode
+	}
+	if p.BlockBody != "" {
+		c.BlockBody = p.BlockBody
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", base.PolicyFile, err)
+	}
+	return &c, nil
+}
+
+// loadPolicy reads Config.PolicyFile and applies it to base.
+func loadPolicy(base *Config) (*Config, error) {
+	p, err := readPolicy(base.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	return applyPolicy(base, p)
+}
+
+// usePolicy makes c the active config.
+func usePolicy(base, c *Config) {
+	policyConfig.Store(c)
+	if metadataServiceAllowed(c) && !metadataServiceAllowed(base) {
+		log.Warn("Cloud metadata service upstreams are allowed by the policy file, make sure it is only reachable through a hardened proxy")
+	}
+}
+
+// watchPolicy loads Config.PolicyFile and starts reloading it on change.
+func watchPolicy(base *Config) (*fileWatcher, error) {
+	if base.PolicyFile == "" {
+		policyConfig.Store(nil)
+		return nil, nil
+	}
+	c, err := loadPolicy(base)
+	if err != nil {
+		return nil, err
+	}
+	usePolicy(base, c)
+	return watchFiles([]string{base.PolicyFile}, func() { reloadPolicy(base) })
+}
+
+// reloadPolicy applies the policy file again. The current policy stays in use if
+// the file can't be read or is invalid.
+func reloadPolicy(base *Config) {
+	c, err := loadPolicy(base)
+	if os.IsNotExist(err) {
+		// Mid-replace, the create that follows triggers another reload.
+		return
+	}
+	if err != nil {
+		policyReloadsTotal.WithLabelValues("error").Inc()
+		log.Errorf("policy file reload error %v, keeping the current policy", err)
+		return
+	}
+	if current := policyConfig.Load(); current != nil && samePolicy(current, c) {
+		return
+	}
+	usePolicy(base, c)
+	policyReloadsTotal.WithLabelValues("success").Inc()
+	log.Infof("Reloaded policy file %s", base.PolicyFile)
+}
+
+// samePolicy reports whether a and b have the same policy settings, so
+// repeated change events for one edit reload once.
+func samePolicy(a, b *Config) bool {
+	return fmt.Sprint(a.AllowedCIDRs, a.DeniedCIDRs, a.AllowMetadataService, a.BlockStatusCode, a.BlockBody) ==
+		fmt.Sprint(b.AllowedCIDRs, b.DeniedCIDRs, b.AllowMetadataService, b.BlockStatusCode, b.BlockBody)
+}
@@ -0,0 +1,74 @@
+package extproc
+
+import (
+	"context"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// workerPool runs decisions on a fixed set of goroutines so stream goroutines
+// only do I/O. A nil *workerPool runs each decision on the caller's goroutine.
+type workerPool struct {
+	jobs chan func()
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		return nil
+	}
+	p := &workerPool{jobs: make(chan func())}
+	for i := 0; i < size; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// decide runs decide on a worker and waits for the response. The stream
+// goroutine waits before reading the next message, so a stream's decisions
+// are still made and sent in message order. It gives up with ctx's error if
+// the stream ends while every worker is busy.
+func (p *workerPool) decide(ctx context.Context, stream *streamState, req *extProcPb.ProcessingRequest) (*extProcPb.ProcessingResponse, error) {
+	if p == nil {
+		return decide(ctx, stream, req), nil
+	}
+
+	type result struct {
+		resp   *extProcPb.ProcessingResponse
+		panicV interface{}
+	}
+	done := make(chan result, 1)
+	job := func() {
+		var r result
+		defer func() {
+			r.panicV = recover()
+			done <- r
+		}()
+		r.resp = decide(ctx, stream, req)
+	}
+	select {
+	case p.jobs <- job:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// A panic is raised again on the stream goroutine, where recoverStream
+	// handles it, rather than taking down the worker.
+	r := <-done
+	if r.panicV != nil {
+		panic(r.panicV)
+	}
+	return r.resp, nil
+}
+
+// close stops the workers once they finish their current decisions. No
+// decisions may be submitted after it is called.
+func (p *workerPool) close() {
+	if p == nil {
+		return
+	}
+	close(p.jobs)
+}
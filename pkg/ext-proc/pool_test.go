@@ -0,0 +1,122 @@
+package extproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// useWorkers makes a pool of size the package workers for the test.
+func useWorkers(t testing.TB, size int) *workerPool {
+	prev := workers
+	workers = newWorkerPool(size)
+	t.Cleanup(func() {
+		workers.close()
+		workers = prev
+	})
+	return workers
+}
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	useConfig(t, &Config{WorkerPoolSize: 2})
+	useWorkers(t, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reqs := []*extProcPb.ProcessingRequest{requestHeaders("93.184.216.34:443")}
+			for j := 0; j < 10; j++ {
+				reqs = append(reqs, requestBody(fmt.Sprint(j), false))
+			}
+			reqs = append(reqs, requestTrailers(), responseHeaders(":status", "200"))
+
+			srv := newFakeProcessStream(context.Background(), reqs...)
+			if err := (&server{}).Process(srv); err != nil {
+				t.Errorf("Process() = %v", err)
+				return
+			}
+			close(srv.sent)
+			var got []string
+			for resp := range srv.sent {
+				got = append(got, fmt.Sprintf("%T", resp.Response))
+			}
+			var want []string
+			for _, req := range reqs {
+				want = append(want, fmt.Sprintf("%T", continueResponseFor(req).Response))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("responses %v, want %v", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// continueResponseFor returns an allowing response of the type Process
+// answers req with.
+func continueResponseFor(req *extProcPb.ProcessingRequest) *extProcPb.ProcessingResponse {
+	switch req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestHeaders:
+		return &extProcPb.ProcessingResponse{Response: &extProcPb.ProcessingResponse_RequestHeaders{}}
+	case *extProcPb.ProcessingRequest_ResponseHeaders:
+		return &extProcPb.ProcessingResponse{Response: &extProcPb.ProcessingResponse_ResponseHeaders{}}
+	default:
+		return continueResponse(req)
+	}
+}
+
+func TestWorkerPoolDispatchCancelled(t *testing.T) {
+	useConfig(t, &Config{})
+	pool := useWorkers(t, 1)
+
+	// Occupy the only worker.
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	go func() {
+		pool.jobs <- func() {
+			close(busy)
+			<-release
+		}
+	}()
+	<-busy
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp, err := pool.decide(ctx, newStreamState(), requestHeaders("93.184.216.34:443"))
+	if !errors.Is(err, context.Canceled) || resp != nil {
+		t.Errorf("decide() = %v, %v, want context.Canceled", resp, err)
+	}
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	cfg := &Config{}
+	if err := cfg.Validate(); err != nil {
+		b.Fatal(err)
+	}
+	prev := config
+	config = cfg
+	b.Cleanup(func() { config = prev })
+	req := requestHeaders("93.184.216.34:443", ":authority", "example.com", ":method", "GET")
+
+	for _, size := range []int{0, 4, 16} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			pool := newWorkerPool(size)
+			defer pool.close()
+			b.RunParallel(func(pb *testing.PB) {
+				stream := newStreamState()
+				for pb.Next() {
+					if _, err := pool.decide(context.Background(), stream, req); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package extproc
+
+import (
+	"context"
+	"time"
+)
+
+const defaultProbeTimeout = 5 * time.Second
+
+// prober is implemented by dependencies that can check they're reachable.
+type prober interface {
+	Probe(ctx context.Context) error
+}
+
+// probeDependencies checks each configured dependency that supports it within
+// Config.ProbeTimeout and logs the result. It returns the first failure.
+func probeDependencies(c *Config) error {
+	timeout := c.ProbeTimeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	deps := map[string]prober{}
+	if p, ok := events.prober(); ok {
+		deps["event sink"] = p
+	}
+
+	var first error
+	for name, p := range deps {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := p.Probe(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("Dependency probe for %s failed: %v", name, err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		log.Infof("Dependency probe for %s succeeded", name)
+	}
+	return first
+}
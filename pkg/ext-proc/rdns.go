@@ -0,0 +1,196 @@
+package extproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	defaultReverseLookupTimeout  = 500 * time.Millisecond
+	defaultReverseLookupCacheTTL = 5 * time.Minute
+	reverseLookupCacheSize       = 10000
+)
+
+type reverseLookupEntry struct {
+	names   []string
+	err     error
+	expires time.Time
+}
+
+// reverseLookupCall is a lookup in progress that other callers for the same
+// address wait on.
+type reverseLookupCall struct {
+	done  chan struct{}
+	names []string
+	err   error
+}
+
+// reverseLookupCache caches PTR lookups per IP, failures included, so a slow
+// or failing resolver is hit at most once per TTL for each address. The TTL is
+// fixed since net.Resolver doesn't return the records' TTLs. It is shared by
+// all streams: concurrent lookups of the same address share one query, and at
+// most Config.MaxConcurrentChecks queries run at once.
+type reverseLookupCache struct {
+	ttl     time.Duration
+	timeout time.Duration
+	lookup  func(ctx context.Context, addr string) ([]string, error)
+	// slots limits concurrent queries, nil when unlimited.
+	slots *semaphore.Weighted
+
+	mu      sync.Mutex
+	entries map[string]reverseLookupEntry
+	pending map[string]*reverseLookupCall
+}
+
+func newReverseLookupCache(ttl, timeout time.Duration, maxConcurrent int) *reverseLookupCache {
+	if ttl <= 0 {
+		ttl = defaultReverseLookupCacheTTL
+	}
+	if timeout <= 0 {
+		timeout = defaultReverseLookupTimeout
+	}
+	c := &reverseLookupCache{
+		ttl:     ttl,
+		timeout: timeout,
+		lookup:  net.DefaultResolver.LookupAddr,
+		entries: make(map[string]reverseLookupEntry),
+		pending: make(map[string]*reverseLookupCall),
+	}
+	if maxConcurrent > 0 {
+		c.slots = semaphore.NewWeighted(int64(maxConcurrent))
+	}
+	return c
+}
+
+// names returns the PTR names for ip. An address without PTR records isn't
+// an error, it just has no names.
+func (c *reverseLookupCache) names(ctx context.Context, ip net.IP) ([]string, error) {
+	key := ip.String()
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		reverseLookupCacheTotal.WithLabelValues("hit").Inc()
+		return e.names, e.err
+	}
+	if call, ok := c.pending[key]; ok {
+		c.mu.Unlock()
+		reverseLookupCacheTotal.WithLabelValues("shared").Inc()
+		select {
+		case <-call.done:
+			return call.names, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &reverseLookupCall{done: make(chan struct{})}
+	c.pending[key] = call
+	c.mu.Unlock()
+	reverseLookupCacheTotal.WithLabelValues("miss").Inc()
+
+	// Saturation is this caller's problem, not the address's: it isn't
+	// cached, and callers sharing the call see the same error.
+	if err := c.acquire(ctx); err != nil {
+		c.mu.Lock()
+		delete(c.pending, key)
+		c.mu.Unlock()
+		call.err = err
+		close(call.done)
+		return nil, err
+	}
+	// The query isn't tied to the first caller's context, other callers
+	// may still be waiting on it after that one is gone.
+	call.names, call.err = c.query(key)
+	c.release()
+
+	c.mu.Lock()
+	delete(c.pending, key)
+	c.evictLocked(now)
+	c.entries[key] = reverseLookupEntry{names: call.names, err: call.err, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	close(call.done)
+	return call.names, call.err
+}
+
+// acquire takes a query slot when queries are limited. It waits no longer
+// than the caller's context, or the lookup timeout when that is shorter, and
+// returns ErrChecksSaturated if no slot frees up in time.
+func (c *reverseLookupCache) acquire(ctx context.Context) error {
+	if c.slots == nil || c.slots.TryAcquire(1) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	checksWaiting.Inc()
+	err := c.slots.Acquire(ctx, 1)
+	checksWaiting.Dec()
+	if err != nil {
+		checksRejectedTotal.Inc()
+		return fmt.Errorf("%w: no reverse lookup slot: %v", ErrChecksSaturated, err)
+	}
+	return nil
+}
+
+// release returns a slot taken by acquire.
+func (c *reverseLookupCache) release() {
+	if c.slots != nil {
+		c.slots.Release(1)
+	}
+}
+
+// query runs one PTR lookup within the timeout. The caller holds a slot.
+func (c *reverseLookupCache) query(addr string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	reverseLookupsInFlight.Inc()
+	defer reverseLookupsInFlight.Dec()
+	start := time.Now()
+	names, err := c.lookup(ctx, addr)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		names, err = nil, nil
+	}
+	resolveDuration.WithLabelValues(resolveOutcome(err)).Observe(time.Since(start).Seconds())
+	return names, err
+}
+
+// resolveOutcome labels a lookup result for extproc_resolve_duration_seconds.
+// A name that doesn't exist is an ok answer.
+func resolveOutcome(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// evictLocked makes room for one entry, dropping expired entries first and an
+// arbitrary one if the cache is still full.
+func (c *reverseLookupCache) evictLocked(now time.Time) {
+	if len(c.entries) < reverseLookupCacheSize {
+		return
+	}
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < reverseLookupCacheSize {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
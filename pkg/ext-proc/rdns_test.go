@@ -0,0 +1,122 @@
+package extproc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// observations returns how many durations the histogram has recorded.
+func observations(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestReverseLookupResolveDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		lookup  func(ctx context.Context, addr string) ([]string, error)
+		outcome string
+	}{
+		{"ok", func(ctx context.Context, addr string) ([]string, error) {
+			return []string{"host.example."}, nil
+		}, "ok"},
+		{"not found", func(ctx context.Context, addr string) ([]string, error) {
+			return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+		}, "ok"},
+		{"timeout", func(ctx context.Context, addr string) ([]string, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, "timeout"},
+		{"dns timeout", func(ctx context.Context, addr string) ([]string, error) {
+			return nil, &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+		}, "timeout"},
+		{"error", func(ctx context.Context, addr string) ([]string, error) {
+			return nil, errors.New("server misbehaving")
+		}, "error"},
+	}
+	for _, tt := range tests {
+		c := newReverseLookupCache(time.Minute, 10*time.Millisecond, 0)
+		c.lookup = tt.lookup
+		before := observations(t, resolveDuration.WithLabelValues(tt.outcome))
+		c.query("192.0.2.1")
+		if got := observations(t, resolveDuration.WithLabelValues(tt.outcome)) - before; got != 1 {
+			t.Errorf("%s: %d %s observations, want 1", tt.name, got, tt.outcome)
+		}
+	}
+}
+
+func TestReverseLookupChecksSaturated(t *testing.T) {
+	cfg := &Config{
+		ReverseLookup:       true,
+		DeniedHosts:         []string{"*.evil.example"},
+		MaxConcurrentChecks: 1,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	cfg.compiled.reverseLookups.lookup = func(ctx context.Context, addr string) ([]string, error) {
+		if addr == "192.0.2.1" {
+			close(started)
+			<-release
+		}
+		return []string{"host.evil.example."}, nil
+	}
+
+	// Hold the only slot.
+	held := make(chan error, 1)
+	go func() {
+		_, err := cfg.compiled.reverseLookups.names(context.Background(), net.ParseIP("192.0.2.1"))
+		held <- err
+	}()
+	<-started
+
+	decide := func() (*Decision, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		in := &DecisionInput{Config: cfg, Phase: PhaseRequestHeaders, UpstreamIP: "192.0.2.2"}
+		return ReverseLookupDecider{}.Decide(ctx, in)
+	}
+
+	rejected := counterValue(t, checksRejectedTotal)
+	_, err := decide()
+	if !errors.Is(err, ErrChecksSaturated) {
+		t.Fatalf("closed: got %v, want ErrChecksSaturated", err)
+	}
+	if d := decisionForError(err); d.ReasonCode != ReasonChecksSaturated || d.StatusCode != 503 {
+		t.Errorf("closed: decision %s %d, want %s 503", d.ReasonCode, d.StatusCode, ReasonChecksSaturated)
+	}
+
+	cfg.FailureMode = FailureModeOpen
+	failOpens := counterValue(t, failOpenTotal.WithLabelValues(string(ReasonChecksSaturated)))
+	if d, err := decide(); d != nil || err != nil {
+		t.Errorf("open: got %v, %v, want a deferral", d, err)
+	}
+	if got := counterValue(t, failOpenTotal.WithLabelValues(string(ReasonChecksSaturated))) - failOpens; got != 1 {
+		t.Errorf("open: %v fail-opens counted, want 1", got)
+	}
+	if got := counterValue(t, checksRejectedTotal) - rejected; got != 2 {
+		t.Errorf("%v checks rejected, want 2", got)
+	}
+
+	// Saturation isn't cached: once the slot is free the lookup runs.
+	close(release)
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	d, err := decide()
+	if err != nil || d == nil || d.ReasonCode != ReasonDeniedHost {
+		t.Errorf("after release: got %v, %v, want %s", d, err, ReasonDeniedHost)
+	}
+}
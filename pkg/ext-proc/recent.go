@@ -0,0 +1,63 @@
+package extproc
+
+import (
+	"sync"
+	"time"
+)
+
+// blockRecord is a blocked decision kept for debugging.
+type blockRecord struct {
+	Time       time.Time  `json:"time"`
+	UpstreamIP string     `json:"upstreamIp"`
+	ReasonCode ReasonCode `json:"reasonCode"`
+	Reason     string     `json:"reason"`
+	RequestID  string     `json:"requestId,omitempty"`
+}
+
+// blockRing holds the last N blocked decisions. It is safe for concurrent use.
+type blockRing struct {
+	mu      sync.Mutex
+	records []blockRecord
+	next    int
+	full    bool
+}
+
+func newBlockRing(size int) *blockRing {
+	if size <= 0 {
+		return nil
+	}
+	return &blockRing{records: make([]blockRecord, size)}
+}
+
+// add records a block, overwriting the oldest entry once full.
+func (r *blockRing) add(rec blockRecord) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the recorded blocks, newest first.
+func (r *blockRing) list() []blockRecord {
+	if r == nil {
+		return []blockRecord{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.records)
+	}
+	out := make([]blockRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.records[(r.next-i+len(r.records))%len(r.records)])
+	}
+	return out
+}
@@ -0,0 +1,228 @@
+package extproc
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// reservedRange is a named special-use range that can be blocked or allowed
+// as a unit through Config.ReservedRanges.
+type reservedRange struct {
+	name   string
+	reason string
+	code   ReasonCode
+	nets   []*net.IPNet
+	// block is the default when the range isn't listed in the config.
+	block bool
+}
+
+// metadataServiceNets are the cloud instance metadata addresses. AWS, GCP
+// and Azure serve metadata from 169.254.169.254, GCP also from fd00:ec2::254.
+var metadataServiceNets = mustParseCIDRs("169.254.169.254/32", "fd00:ec2::254/128")
+
+// nat64Nets is the RFC 6052 well-known NAT64 prefix, the IPv4 address is in
+// the last four bytes.
+var nat64Nets = mustParseCIDRs("64:ff9b::/96")
+
+// nat64IPv4 returns the IPv4 address embedded in a well-known NAT64 address,
+// nil for any other address.
+func nat64IPv4(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len || matchIP(nat64Nets, ip) == nil {
+		return nil
+	}
+	return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+}
+
+// reservedRanges is the table isUpstreamIPSafe checks, in order. It follows
+// the IANA IPv4 and IPv6 Special-Purpose Address Registries plus the cloud
+// metadata addresses. Where ranges overlap the first entry wins, so the order
+// decides the reason reported. All but nat64 are blocked by default.
+var reservedRanges = []reservedRange{
+	{
+		name:   "loopback",
+		reason: "localhost/loopback address is blocked",
+		code:   ReasonLoopback,
+		nets:   mustParseCIDRs("127.0.0.0/8", "::1/128"),
+		block:  true,
+	},
+	{
+		name:   "unspecified",
+		reason: "unspecified address is blocked",
+		code:   ReasonUnspecified,
+		nets:   mustParseCIDRs("0.0.0.0/32", "::/128"),
+		block:  true,
+	},
+	{
+		name:   "link-local",
+		reason: "link-local address is blocked",
+		code:   ReasonLinkLocal,
+		nets:   mustParseCIDRs("169.254.0.0/16", "fe80::/10"),
+		block:  true,
+	},
+	{
+		name:   "multicast",
+		reason: "multicast address is blocked",
+		code:   ReasonMulticast,
+		nets:   mustParseCIDRs("224.0.0.0/4", "ff00::/8"),
+		block:  true,
+	},
+	{
+		// RFC 1918 and IPv6 unique local addresses
+		name:   "private",
+		reason: "private network address is blocked (RFC1918)",
+		code:   ReasonPrivate,
+		nets:   mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"),
+		block:  true,
+	},
+	{
+		// Only reached when the link-local or private entries are allowed.
+		name:   "metadata-service",
+		reason: "cloud metadata service address is blocked",
+		code:   ReasonMetadata,
+		nets:   metadataServiceNets,
+		block:  true,
+	},
+	{
+		name:   "this-network",
+		reason: "\"this network\" range is blocked (0.0.0.0/8)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("0.0.0.0/8"),
+		block:  true,
+	},
+	{
+		name:   "cgnat",
+		reason: "carrier-grade NAT range is blocked (100.64.0.0/10)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("100.64.0.0/10"),
+		block:  true,
+	},
+	{
+		name:   "ietf-protocol",
+		reason: "IETF protocol assignment range is blocked (192.0.0.0/24)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("192.0.0.0/24"),
+		block:  true,
+	},
+	{
+		// IPv4: 192.0.2.0/24, 198.51.100.0/24, 203.0.113.0/24 (TEST-NET-1,2,3)
+		// IPv6: 2001:db8::/32, 3fff::/20
+		name:   "documentation",
+		reason: "documentation/test network range is blocked",
+		code:   ReasonDocumentation,
+		nets:   mustParseCIDRs("192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32", "3fff::/20"),
+		block:  true,
+	},
+	{
+		name:   "6to4-relay",
+		reason: "6to4 relay anycast range is blocked (192.88.99.0/24)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("192.88.99.0/24"),
+		block:  true,
+	},
+	{
+		name:   "benchmarking",
+		reason: "benchmarking range is blocked (198.18.0.0/15, 2001:2::/48)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("198.18.0.0/15", "2001:2::/48"),
+		block:  true,
+	},
+	{
+		name:   "reserved",
+		reason: "reserved range is blocked (240.0.0.0/4)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("240.0.0.0/4"),
+		block:  true,
+	},
+	{
+		// The well-known NAT64 prefix is how IPv6-only clusters reach IPv4
+		// upstreams. It is allowed by default, isUpstreamIPSafe checks the
+		// embedded IPv4 address instead.
+		name:   "nat64",
+		reason: "NAT64 address is blocked (64:ff9b::/96)",
+		code:   ReasonReserved,
+		nets:   nat64Nets,
+	},
+	{
+		// Both embed an IPv4 address that may be private
+		name:   "ipv4-translation",
+		reason: "local NAT64/6to4 address embedding IPv4 is blocked",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("64:ff9b:1::/48", "2002::/16"),
+		block:  true,
+	},
+	{
+		// Teredo embeds the client's IPv4 address and port, obfuscated
+		name:   "teredo",
+		reason: "Teredo tunnelling range is blocked (2001::/32)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("2001::/32"),
+		block:  true,
+	},
+	{
+		name:   "orchid",
+		reason: "ORCHIDv2 range is blocked (2001:20::/28)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("2001:20::/28"),
+		block:  true,
+	},
+	{
+		name:   "discard",
+		reason: "discard-only range is blocked (100::/64)",
+		code:   ReasonReserved,
+		nets:   mustParseCIDRs("100::/64"),
+		block:  true,
+	},
+}
+
+// compileReservedRanges returns the ranges to block, applying the per-name
+// overrides in c.ReservedRanges on top of the defaults. AllowLoopback changes
+// the loopback default to allow.
+func compileReservedRanges(c *Config) ([]reservedRange, error) {
+	settings := c.ReservedRanges
+	known := make(map[string]bool, len(reservedRanges))
+	for _, r := range reservedRanges {
+		known[r.name] = true
+	}
+	for name := range settings {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown reserved range %q, expected one of %s", name, strings.Join(reservedRangeNames(), ", "))
+		}
+	}
+
+	var enabled []reservedRange
+	for _, r := range reservedRanges {
+		block, ok := settings[r.name]
+		if !ok {
+			block = r.block && !(r.name == "loopback" && c.AllowLoopback)
+		}
+		if block {
+			enabled = append(enabled, r)
+		}
+	}
+	return enabled, nil
+}
+
+// metadataServiceAllowed reports whether c lets requests reach the cloud
+// metadata service, through AllowMetadataService or AllowedCIDRs.
+func metadataServiceAllowed(c *Config) bool {
+	if c.AllowMetadataService {
+		return true
+	}
+	for _, n := range metadataServiceNets {
+		if c.compiled.allowedNets.lookup(n.IP) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func reservedRangeNames() []string {
+	names := make([]string, 0, len(reservedRanges))
+	for _, r := range reservedRanges {
+		names = append(names, r.name)
+	}
+	sort.Strings(names)
+	return names
+}
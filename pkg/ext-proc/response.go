@@ -0,0 +1,337 @@
+package extproc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// blockBodyData is what a Config.BlockBody template is executed with.
+type blockBodyData struct {
+	UpstreamIP  string
+	ReasonCode  ReasonCode
+	Reason      string
+	MatchedRule string
+	RequestID   string
+	StatusCode  int
+}
+
+// blockBodyFuncs are the functions Config.BlockBody templates can call. json
+// renders a value as a JSON literal, so a string is quoted and escaped and a
+// JSON envelope stays valid whatever the reason contains.
+var blockBodyFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+}
+
+// problemDetails is an RFC 7807 problem document for a block.
+type problemDetails struct {
+	Type       string     `json:"type"`
+	Title      string     `json:"title"`
+	Status     int        `json:"status"`
+	Detail     string     `json:"detail"`
+	ReasonCode ReasonCode `json:"reasonCode"`
+	RequestID  string     `json:"requestId,omitempty"`
+}
+
+// blockedMessage is what clients are told about a block by default. The
+// reason itself can reveal policy detail, so it is only in the response
+// details, the decision metadata and the logs.
+const blockedMessage = "request blocked by upstream policy"
+
+// problemTypePrefix prefixes the lower-cased reason code to form the problem
+// type URI.
+const problemTypePrefix = "urn:envoy-ext-proc:block:"
+
+// blockBody renders the body of a block: a problem document with
+// BlockFormatProblem, otherwise Config.BlockBody, falling back to
+// blockedMessage without a template or if it fails.
+func blockBody(cfg *Config, stream *streamState, decision Decision, code int) string {
+	if cfg.BlockFormat == BlockFormatProblem {
+		problem := problemDetails{
+			Type:       problemTypePrefix + strings.ToLower(string(decision.ReasonCode)),
+			Title:      http.StatusText(code),
+			Status:     code,
+			Detail:     blockedMessage,
+			ReasonCode: decision.ReasonCode,
+		}
+		if stream != nil {
+			problem.RequestID = stream.requestID
+		}
+		out, err := json.Marshal(problem)
+		if err != nil {
+			return blockedMessage
+		}
+		return string(out)
+	}
+	if cfg.compiled == nil || cfg.compiled.blockBody == nil {
+		return blockedMessage
+	}
+	data := blockBodyData{
+		ReasonCode:  decision.ReasonCode,
+		Reason:      decision.ReasonText,
+		MatchedRule: decision.MatchedRule,
+		StatusCode:  code,
+	}
+	if stream != nil {
+		data.UpstreamIP = stream.upstreamIP
+		data.RequestID = stream.requestID
+	}
+	var b strings.Builder
+	if err := cfg.compiled.blockBody.Execute(&b, data); err != nil {
+		log.Errorf("block body template error %v", err)
+		return blockedMessage
+	}
+	return b.String()
+}
+
+// blockResponse builds the immediate response that denies a request. gRPC
+// clients expect a trailers-only response with HTTP 200 and the failure in
+// grpc-status/grpc-message, everyone else gets the decision's status code with
+// the blockBody. Neither carries the reason, which goes in the details. A
+// decision without a status code, as custom Deciders may return, is a 403.
+// stream may be nil.
+func blockResponse(cfg *Config, stream *streamState, decision Decision, grpcRequest bool) *extProcPb.ProcessingResponse {
+	code := decision.StatusCode
+	if code == 0 {
+		code = http.StatusForbidden
+	}
+	if code == http.StatusForbidden && cfg.BlockStatusCode != 0 {
+		code = cfg.BlockStatusCode
+	}
+	body := blockBody(cfg, stream, decision, code)
+	immediate := &extProcPb.ImmediateResponse{
+		Status: &typev3.HttpStatus{
+			Code: typev3.StatusCode(code),
+		},
+		Body:    []byte(body),
+		Details: blockDetails(decision),
+	}
+
+	if cfg.BlockGrpcStatus != nil {
+		immediate.GrpcStatus = &extProcPb.GrpcStatus{Status: *cfg.BlockGrpcStatus}
+	}
+
+	if grpcRequest {
+		immediate.Status.Code = typev3.StatusCode_OK
+		immediate.Body = nil
+		immediate.Headers = &extProcPb.HeaderMutation{
+			SetHeaders: []*corev3.HeaderValueOption{
+				setHeader("content-type", "application/grpc"),
+				setHeader("grpc-status", strconv.Itoa(int(blockGrpcCode(cfg)))),
+				setHeader("grpc-message", encodeGrpcMessage(blockedMessage)),
+			},
+		}
+	} else {
+		immediate.Headers = &extProcPb.HeaderMutation{
+			SetHeaders: []*corev3.HeaderValueOption{
+				setHeader("content-type", blockContentType(cfg)),
+			},
+		}
+	}
+	for name, value := range cfg.BlockHeaders {
+		immediate.Headers.SetHeaders = append(immediate.Headers.SetHeaders, setHeader(name, value))
+	}
+
+	return &extProcPb.ProcessingResponse{
+		Response: &extProcPb.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: immediate,
+		},
+	}
+}
+
+// blockDetails is the ImmediateResponse.Details for a block: the reason code,
+// matched rule and reason text. Envoy records it as the response code details
+// in its access logs but never sends it to the client. Whitespace isn't valid
+// there so it becomes underscores.
+func blockDetails(decision Decision) string {
+	details := "extproc_blocked{" + string(decision.ReasonCode) + "}"
+	if decision.MatchedRule != "" {
+		details += "{" + decision.MatchedRule + "}"
+	}
+	if decision.ReasonText != "" {
+		details += "{" + decision.ReasonText + "}"
+	}
+	return strings.Join(strings.Fields(details), "_")
+}
+
+// continueStatus returns the status for an allowed header response:
+// CONTINUE_AND_REPLACE when Config.ContinueAndReplace is set and the response
+// mutates headers, CONTINUE otherwise.
+func continueStatus(cfg *Config, mutation *extProcPb.HeaderMutation) extProcPb.CommonResponse_ResponseStatus {
+	if cfg.ContinueAndReplace && mutation != nil {
+		return extProcPb.CommonResponse_CONTINUE_AND_REPLACE
+	}
+	return extProcPb.CommonResponse_CONTINUE
+}
+
+// decisionMetadata builds the dynamic metadata emitted with a decision. The
+// fields are nested under Config.MetadataNamespace when one is set.
+func decisionMetadata(cfg *Config, stream *streamState, decision Decision) *structpb.Struct {
+	decidedAt := time.Now()
+	fields := map[string]*structpb.Value{
+		"blocked":       structpb.NewBoolValue(!decision.Allow),
+		"processing_ms": structpb.NewNumberValue(float64(decidedAt.Sub(stream.start).Microseconds()) / 1000),
+		"decided_at":    structpb.NewStringValue(decidedAt.UTC().Format(time.RFC3339)),
+	}
+	// reason_code is the same ReasonCode used for metric labels, stable for
+	// consumers such as RBAC; reason is the human readable text.
+	if decision.ReasonCode != "" {
+		fields["reason_code"] = structpb.NewStringValue(string(decision.ReasonCode))
+	}
+	if !decision.Allow {
+		fields["reason"] = structpb.NewStringValue(decision.ReasonText)
+	}
+	if stream.upstreamSource != "" {
+		fields["upstream_source"] = structpb.NewStringValue(stream.upstreamSource)
+	}
+	if stream.upstreamCluster != "" {
+		fields["upstream_cluster"] = structpb.NewStringValue(stream.upstreamCluster)
+	}
+	if stream.bypassed {
+		fields["bypassed"] = structpb.NewBoolValue(true)
+	}
+	if stream.requestID != "" {
+		fields["request_id"] = structpb.NewStringValue(stream.requestID)
+	}
+
+	metadata := &structpb.Struct{Fields: fields}
+	if cfg.MetadataNamespace == "" {
+		return metadata
+	}
+	return &structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			cfg.MetadataNamespace: structpb.NewStructValue(metadata),
+		},
+	}
+}
+
+// blockContentType is the content type of non-gRPC block bodies.
+func blockContentType(cfg *Config) string {
+	if cfg.BlockFormat == BlockFormatProblem {
+		return "application/problem+json"
+	}
+	if cfg.BlockContentType != "" {
+		return cfg.BlockContentType
+	}
+	return "text/plain"
+}
+
+// blockGrpcCode is the gRPC status reported to gRPC clients on block.
+func blockGrpcCode(cfg *Config) codes.Code {
+	if cfg.BlockGrpcStatus != nil {
+		return codes.Code(*cfg.BlockGrpcStatus)
+	}
+	return codes.PermissionDenied
+}
+
+// decisionHeaderName carries the verdict when Config.DebugDecisionHeader is set.
+const decisionHeaderName = "x-extproc-decision"
+
+// decisionHeader returns the debug header for a decision, "allowed" or
+// "blocked:<reason code>".
+func decisionHeader(decision Decision) *corev3.HeaderValueOption {
+	value := "allowed"
+	if !decision.Allow {
+		value = "blocked:" + strings.ToLower(string(decision.ReasonCode))
+	}
+	return setHeader(decisionHeaderName, value)
+}
+
+// responseHeadersFor returns the headers to set on the upstream response for
+// an allowed request: the request id with Config.EchoRequestID, the verdict
+// in Config.ResponseVerdictHeader and the debug decision header.
+func responseHeadersFor(cfg *Config, stream *streamState, decision Decision) []*corev3.HeaderValueOption {
+	var headers []*corev3.HeaderValueOption
+	if cfg.EchoRequestID && stream.requestID != "" {
+		headers = append(headers, setHeader(requestIDHeader(cfg), stream.requestID))
+	}
+	if cfg.ResponseVerdictHeader != "" {
+		value := string(decision.ReasonCode)
+		if decision.MatchedRule != "" {
+			value += "; rule=" + decision.MatchedRule
+		}
+		headers = append(headers, setHeader(cfg.ResponseVerdictHeader, value))
+	}
+	if cfg.DebugDecisionHeader {
+		headers = append(headers, decisionHeader(decision))
+	}
+	return headers
+}
+
+// setHeader returns a header mutation that overwrites the named header.
+func setHeader(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{
+			Key:      key,
+			RawValue: []byte(value),
+		},
+		AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+}
+
+// encodeGrpcMessage percent-encodes a grpc-message value as required by the
+// gRPC over HTTP/2 spec.
+func encodeGrpcMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func (r ResponseStatusRule) validate() error {
+	if r.Min < 100 || r.Max > 599 || r.Min > r.Max {
+		return fmt.Errorf("invalid response status range %d-%d", r.Min, r.Max)
+	}
+	switch r.Action {
+	case ResponseStatusContinue, ResponseStatusBlock:
+	case ResponseStatusAddHeader:
+		if r.HeaderName == "" {
+			return fmt.Errorf("response status rule %d-%d adds a header but has no header name", r.Min, r.Max)
+		}
+	default:
+		return fmt.Errorf("invalid response status action %q", r.Action)
+	}
+	return nil
+}
+
+// String formats the range as it appears in MatchedRule.
+func (r ResponseStatusRule) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// matchResponseStatus returns the first Config.ResponseStatusRules entry for
+// the response's :status, or nil.
+func matchResponseStatus(cfg *Config, headers *corev3.HeaderMap) *ResponseStatusRule {
+	status, err := strconv.Atoi(getHeader(headers, ":status"))
+	if err != nil {
+		return nil
+	}
+	for i, r := range cfg.ResponseStatusRules {
+		if status >= r.Min && status <= r.Max {
+			return &cfg.ResponseStatusRules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package extproc
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+func TestBlockResponseStatus(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          int
+		blockStatusCode int
+		want            typev3.StatusCode
+	}{
+		{"default", http.StatusForbidden, 0, typev3.StatusCode_Forbidden},
+		{"unset", 0, 0, typev3.StatusCode_Forbidden},
+		{"unset with block status", 0, http.StatusNotFound, typev3.StatusCode_NotFound},
+		{"block status", http.StatusForbidden, http.StatusNotFound, typev3.StatusCode_NotFound},
+		{"own status", http.StatusMethodNotAllowed, http.StatusNotFound, typev3.StatusCode_MethodNotAllowed},
+	}
+	for _, tt := range tests {
+		cfg := &Config{BlockStatusCode: tt.blockStatusCode}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		d := Decision{ReasonCode: ReasonDeciderError, ReasonText: "custom", StatusCode: tt.status}
+		if got := immediateStatus(blockResponse(cfg, nil, d, false)); got != tt.want {
+			t.Errorf("%s: status = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBlockBodyJSONTemplate(t *testing.T) {
+	cfg := &Config{BlockBody: `{"error": {{json .Reason}}, "code": {{json .ReasonCode}}, "status": {{json .StatusCode}}}`}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	d := blocked(ReasonDeniedHost, `host "evil\internal" </script>`, "")
+
+	body := blockResponse(cfg, nil, d, false).GetImmediateResponse().GetBody()
+	var got struct {
+		Error  string
+		Code   string
+		Status int
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("body %s isn't valid JSON: %v", body, err)
+	}
+	if got.Error != d.ReasonText || got.Code != string(ReasonDeniedHost) || got.Status != http.StatusForbidden {
+		t.Errorf("body = %+v, want the reason, code and status", got)
+	}
+}
+
+func TestBlockResponseKeepsReasonServerSide(t *testing.T) {
+	d := blocked(ReasonDeniedCIDR, "address is in a denied CIDR", "10.20.0.0/16")
+	for _, format := range []string{BlockFormatText, BlockFormatProblem} {
+		cfg := &Config{BlockFormat: format}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		for _, grpcRequest := range []bool{false, true} {
+			immediate := blockResponse(cfg, nil, d, grpcRequest).GetImmediateResponse()
+			details := immediate.GetDetails()
+			if !strings.Contains(details, string(ReasonDeniedCIDR)) || !strings.Contains(details, "10.20.0.0/16") {
+				t.Errorf("%s grpc=%v: details = %q, want the reason code and rule", format, grpcRequest, details)
+			}
+			client := string(immediate.GetBody()) + mutationHeaders(immediate.GetHeaders())["grpc-message"]
+			if strings.Contains(client, "denied CIDR") || strings.Contains(client, "10.20.0.0/16") {
+				t.Errorf("%s grpc=%v: client sees %q, want a generic message", format, grpcRequest, client)
+			}
+		}
+	}
+}
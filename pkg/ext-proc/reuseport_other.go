@@ -0,0 +1,11 @@
+//go:build !unix
+
+package extproc
+
+import "syscall"
+
+const reusePortSupported = false
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,201 @@
+package extproc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// matchIP returns the first network containing ip, or nil.
+func matchIP(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// checkStep is one check evaluated by isUpstreamIPSafe and its outcome.
+type checkStep struct {
+	Check  string `json:"check"`
+	Result string `json:"result"`
+	Rule   string `json:"rule,omitempty"`
+}
+
+// Check outcomes.
+const (
+	checkMatch   = "match"
+	checkNoMatch = "no-match"
+)
+
+// checkTrace records the checks isUpstreamIPSafe evaluates, in order. A nil
+// *checkTrace records nothing.
+type checkTrace []checkStep
+
+func (t *checkTrace) add(check, result, rule string) {
+	if t != nil {
+		*t = append(*t, checkStep{Check: check, Result: result, Rule: rule})
+	}
+}
+
+// String formats the trace for logs, e.g. "allowed-cidrs: no-match, loopback:
+// no-match".
+func (t checkTrace) String() string {
+	steps := make([]string, len(t))
+	for i, s := range t {
+		steps[i] = s.Check + ": " + s.Result
+		if s.Rule != "" {
+			steps[i] += " (" + s.Rule + ")"
+		}
+	}
+	return strings.Join(steps, ", ")
+}
+
+// IPSafetyChecker checks whether an upstream IP is safe to connect to. ip is
+// normalized, without a port, and IPv4-mapped addresses are reduced to IPv4.
+// A Decision with Allow set and ReasonAllowed passes the address on to the
+// next checker in Config.IPCheckers; any other Decision ends the chain.
+// Returning an error blocks the request, as it does for a Decider.
+type IPSafetyChecker interface {
+	Check(ctx context.Context, ip string) (Decision, error)
+}
+
+// IPSafetyCheckerFunc adapts an ordinary function to the IPSafetyChecker
+// interface.
+type IPSafetyCheckerFunc func(ctx context.Context, ip string) (Decision, error)
+
+// Check calls f(ctx, ip).
+func (f IPSafetyCheckerFunc) Check(ctx context.Context, ip string) (Decision, error) {
+	return f(ctx, ip)
+}
+
+// BuiltinIPChecker is the default IPSafetyChecker: the configured CIDR lists
+// and the special-purpose ranges. Config pins the checks to that config; when
+// nil, the zero value, they use the config the request is being evaluated
+// against, so policy file reloads apply.
+type BuiltinIPChecker struct {
+	Config *Config
+}
+
+// Check implements IPSafetyChecker.
+func (b BuiltinIPChecker) Check(ctx context.Context, ip string) (Decision, error) {
+	cfg := b.Config
+	if cfg == nil {
+		cfg = evaluatedConfig(ctx)
+	}
+	if cfg == nil || cfg.compiled == nil {
+		return Decision{}, errors.New("built-in IP checker has no validated config")
+	}
+	return isUpstreamIPSafe(cfg, net.ParseIP(ip)), nil
+}
+
+// configKey is the context key of the config a request is evaluated against.
+type configKey struct{}
+
+// evaluatedConfig returns the config checkIP is evaluating against, or the
+// active config outside of it.
+func evaluatedConfig(ctx context.Context) *Config {
+	if cfg, ok := ctx.Value(configKey{}).(*Config); ok {
+		return cfg
+	}
+	return activeConfig()
+}
+
+// checkIP runs the IP safety checks for ip: Config.IPCheckers when set,
+// otherwise the built-in checks, traced with Config.TraceIPChecks.
+func checkIP(ctx context.Context, cfg *Config, ip net.IP) (Decision, error) {
+	if len(cfg.IPCheckers) == 0 {
+		if !cfg.TraceIPChecks {
+			return isUpstreamIPSafe(cfg, ip), nil
+		}
+		var trace checkTrace
+		d := traceUpstreamIP(cfg, ip, &trace)
+		log.Debugf("IP checks for %s: %s -> %s", ip, trace, d.ReasonCode)
+		return d, nil
+	}
+
+	ctx = context.WithValue(ctx, configKey{}, cfg)
+	for _, checker := range cfg.IPCheckers {
+		d, err := checker.Check(ctx, ip.String())
+		if err != nil {
+			return Decision{}, err
+		}
+		if !d.Allow || d.ReasonCode != ReasonAllowed {
+			return d, nil
+		}
+	}
+	return Decision{Allow: true, ReasonCode: ReasonAllowed}, nil
+}
+
+// isUpstreamIPSafe checks if the upstream IP is safe to connect to. The IP is
+// expected to come from normalizeAddress.
+func isUpstreamIPSafe(cfg *Config, ip net.IP) Decision {
+	return traceUpstreamIP(cfg, ip, nil)
+}
+
+// traceUpstreamIP is isUpstreamIPSafe, recording each check in trace.
+func traceUpstreamIP(cfg *Config, ip net.IP, trace *checkTrace) Decision {
+	if ip == nil {
+		trace.add("address", "invalid", "")
+		return blocked(ReasonInvalidAddress, "invalid IP address", "")
+	}
+
+	// Configured ranges win over the built-in checks, allow before deny
+	if n := cfg.compiled.allowedNets.lookup(ip); n != nil {
+		trace.add("allowed-cidrs", checkMatch, n.String())
+		return Decision{Allow: true, ReasonCode: ReasonAllowedCIDR, MatchedRule: n.String()}
+	}
+	trace.add("allowed-cidrs", checkNoMatch, "")
+	if cfg.Mode == ModeAllowlistOnly {
+		trace.add("allowlist-only", checkMatch, "")
+		return blocked(ReasonNotAllowlisted, "address is not in an allowed CIDR", "")
+	}
+	if n := cfg.compiled.deniedNets.lookup(ip); n != nil {
+		trace.add("denied-cidrs", checkMatch, n.String())
+		return blocked(ReasonDeniedCIDR, "address is in a denied CIDR", n.String())
+	}
+	trace.add("denied-cidrs", checkNoMatch, "")
+	if cfg.AllowMetadataService {
+		if n := matchIP(metadataServiceNets, ip); n != nil {
+			trace.add("allow-metadata-service", checkMatch, n.String())
+			return Decision{Allow: true, ReasonCode: ReasonAllowedMetadata, MatchedRule: "metadata-service"}
+		}
+		trace.add("allow-metadata-service", checkNoMatch, "")
+	}
+
+	// IPv4-mapped IPv6 addresses are reduced to IPv4 by normalizeAddress, so
+	// the IPv4 entries already cover them.
+
+	// Special-purpose ranges enabled in Config.ReservedRanges
+	for _, r := range cfg.compiled.reservedRanges {
+		if n := matchIP(r.nets, ip); n != nil {
+			trace.add(r.name, checkMatch, n.String())
+			return blocked(r.code, r.reason, r.name)
+		}
+		trace.add(r.name, checkNoMatch, "")
+	}
+
+	// A NAT64 address connects to the IPv4 address it embeds, which gets the
+	// same checks as if it were the upstream.
+	if ip4 := nat64IPv4(ip); ip4 != nil {
+		trace.add("nat64-ipv4", checkMatch, ip4.String())
+		return traceUpstreamIP(cfg, ip4, trace)
+	}
+
+	// If all checks pass, the IP is considered safe
+	return Decision{Allow: true, ReasonCode: ReasonAllowed}
+}
@@ -0,0 +1,84 @@
+package extproc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBuiltinIPCheckerZeroValue(t *testing.T) {
+	var custom int
+	cfg := &Config{
+		DeniedCIDRs: []string{"93.184.216.0/24"},
+		IPCheckers: []IPSafetyChecker{
+			IPSafetyCheckerFunc(func(ctx context.Context, ip string) (Decision, error) {
+				custom++
+				return Decision{Allow: true, ReasonCode: ReasonAllowed}, nil
+			}),
+			BuiltinIPChecker{},
+		},
+	}
+
+	tests := []struct {
+		addr string
+		want ReasonCode
+	}{
+		{"93.184.216.34:443", ReasonDeniedCIDR},
+		{"10.0.0.1:80", ReasonPrivate},
+		{"1.1.1.1:443", ReasonAllowed},
+	}
+	for _, tt := range tests {
+		if d := Evaluate(cfg, requestHeaders(tt.addr)); d.ReasonCode != tt.want {
+			t.Errorf("Evaluate(%s) = %s, want %s", tt.addr, d.ReasonCode, tt.want)
+		}
+	}
+	if custom != len(tests) {
+		t.Errorf("custom checker ran %d times, want %d", custom, len(tests))
+	}
+}
+
+func TestBuiltinIPCheckerActiveConfig(t *testing.T) {
+	base := useConfig(t, &Config{})
+	d, err := BuiltinIPChecker{}.Check(context.Background(), "93.184.216.34")
+	if err != nil || d.ReasonCode != ReasonAllowed {
+		t.Fatalf("Check() = %+v, %v, want %s", d, err, ReasonAllowed)
+	}
+
+	// A policy reload changes the config the zero value checks against.
+	reloaded, err := applyPolicy(base, &Policy{DeniedCIDRs: []string{"93.184.216.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyConfig.Store(reloaded)
+	t.Cleanup(func() { policyConfig.Store(nil) })
+	d, err = BuiltinIPChecker{}.Check(context.Background(), "93.184.216.34")
+	if err != nil || d.ReasonCode != ReasonDeniedCIDR {
+		t.Errorf("Check() after reload = %+v, %v, want %s", d, err, ReasonDeniedCIDR)
+	}
+}
+
+func TestNAT64EmbeddedIPv4(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *Config
+		addr string
+		want ReasonCode
+	}{
+		{"public", &Config{}, "[64:ff9b::5db8:d822]:443", ReasonAllowed},
+		{"dotted public", &Config{}, "[64:ff9b::93.184.216.34]:443", ReasonAllowed},
+		{"private", &Config{}, "[64:ff9b::a00:1]:443", ReasonPrivate},
+		{"loopback", &Config{}, "[64:ff9b::7f00:1]:443", ReasonLoopback},
+		{"metadata", &Config{}, "[64:ff9b::169.254.169.254]:80", ReasonLinkLocal},
+		{"denied IPv4", &Config{DeniedCIDRs: []string{"93.184.216.0/24"}}, "[64:ff9b::5db8:d822]:443", ReasonDeniedCIDR},
+		{"allowed IPv4", &Config{AllowedCIDRs: []string{"10.1.0.0/16"}}, "[64:ff9b::a01:203]:443", ReasonAllowedCIDR},
+		{"range blocked", &Config{ReservedRanges: map[string]bool{"nat64": true}}, "[64:ff9b::5db8:d822]:443", ReasonReserved},
+		{"local prefix", &Config{}, "[64:ff9b:1::5db8:d822]:443", ReasonReserved},
+		{"6to4", &Config{}, "[2002:5db8:d822::1]:443", ReasonReserved},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := Evaluate(tt.cfg, requestHeaders(tt.addr)); d.ReasonCode != tt.want {
+				t.Errorf("Evaluate(%s) = %s (%s), want %s", tt.addr, d.ReasonCode, d.ReasonText, tt.want)
+			}
+		})
+	}
+}
@@ -2,21 +2,27 @@ package extproc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
-	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	healthPb "google.golang.org/grpc/health/grpc_health_v1"
-	"google.golang.org/protobuf/types/known/structpb"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 )
@@ -24,227 +30,670 @@ import (
 type server struct{}
 type healthServer struct{}
 
-// extractUpstreamIP extracts the upstream IP address from request attributes
-func extractUpstreamIP(attributes map[string]*structpb.Struct) string {
-	if attributes == nil {
-		return ""
+// Health service names. Liveness only reflects that the process is up;
+// readiness is NOT_SERVING until Config.StartupGracePeriod has passed since
+// the listeners came up, and again once shutdown starts so Envoy can drain
+// traffic to other processors first. Init has loaded the config and its
+// dependencies before Run starts listening.
+const (
+	healthLiveness  = "liveness"
+	healthReadiness = "readiness"
+)
+
+// shuttingDown is set when Run starts shutting down.
+var shuttingDown atomic.Bool
+
+// decisions counts request decisions for Config.MaxRequests.
+var decisions atomic.Int64
+
+// recycle is closed once Config.MaxRequests decisions have been made, which
+// shuts Run down as SIGTERM would.
+var (
+	recycle     = make(chan struct{})
+	recycleOnce sync.Once
+)
+
+// countDecision counts a request decision against Config.MaxRequests.
+func countDecision() {
+	if config.MaxRequests <= 0 {
+		return
 	}
+	if decisions.Add(1) == config.MaxRequests {
+		recycleOnce.Do(func() {
+			log.Infof("Served %d requests, shutting down for recycling", config.MaxRequests)
+			close(recycle)
+		})
+	}
+}
+
+// readyAt is when the startup grace period ends, in Unix nanoseconds.
+var readyAt atomic.Int64
+
+// ready reports whether readiness should be SERVING.
+func ready() bool {
+	return !shuttingDown.Load() && time.Now().UnixNano() >= readyAt.Load()
+}
 
-	filterAttributes := attributes["envoy.filters.http.ext_proc"]
-	if filterAttributes == nil || filterAttributes.Fields == nil {
-		return ""
+func (s *healthServer) Check(ctx context.Context, in *healthPb.HealthCheckRequest) (*healthPb.HealthCheckResponse, error) {
+	log.Printf("Handling grpc Check request + %s", in.String())
+	if in.Service == healthReadiness && !ready() {
+		return &healthPb.HealthCheckResponse{Status: healthPb.HealthCheckResponse_NOT_SERVING}, nil
 	}
+	return &healthPb.HealthCheckResponse{Status: healthPb.HealthCheckResponse_SERVING}, nil
+}
 
-	// Try upstream.address first (available in upstream filter during request)
-	if upstream, ok := filterAttributes.Fields["upstream.address"]; ok {
-		if upstream != nil {
-			upstreamAddr := upstream.GetStringValue()
-			if upstreamAddr != "" {
-				return strings.Split(upstreamAddr, ":")[0]
-			}
+func (s *healthServer) Watch(in *healthPb.HealthCheckRequest, srv healthPb.Health_WatchServer) error {
+	return status.Error(codes.Unimplemented, "Watch is not implemented")
+}
+
+// Demo Ext-Proc server
+func (s *server) Process(srv extProcPb.ExternalProcessor_ProcessServer) error {
+	ctx := srv.Context()
+	stream := newStreamState()
+
+	for {
+		select {
+		case <-ctx.Done():
+			partialBody(stream)
+			return streamReset(ctx.Err())
+		default:
+		}
+
+		req, err := srv.Recv()
+		if err == io.EOF {
+			partialBody(stream)
+			return nil
+		} else if isStreamReset(ctx, err) {
+			partialBody(stream)
+			return streamReset(err)
+		} else if err != nil {
+			return recvError(err)
+		}
+
+		phaseTotal.WithLabelValues(phaseLabel(req)).Inc()
+		if err := stream.throttle(ctx); err != nil {
+			return streamReset(err)
+		}
+		resp, err := workers.decide(ctx, stream, req)
+		if err != nil {
+			partialBody(stream)
+			return streamReset(err)
+		}
+		if err := srv.Send(resp); err != nil {
+			log.Printf("send error %v", err)
 		}
 	}
-	return ""
 }
 
-// isUpstreamIPSafe checks if the upstream IP is safe to connect to
-// Returns true if safe, false if the IP should be blocked
-func isUpstreamIPSafe(ipStr string) (bool, string) {
-	if ipStr == "" {
-		return false, "empty IP address"
-	}
+// isStreamReset reports whether a Recv error is Envoy cancelling or resetting
+// the stream, part of normal operation, rather than a genuine failure.
+func isStreamReset(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled
+}
 
-	// Parse the IP address
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return false, "invalid IP address"
+// recvError is the status to end a stream with after a failed Recv. A typed
+// gRPC error keeps its code so it's attributed correctly; anything else is
+// Unknown.
+func recvError(err error) error {
+	if st, ok := status.FromError(err); ok {
+		return status.Errorf(st.Code(), "cannot receive stream request: %s", st.Message())
 	}
+	return status.Errorf(codes.Unknown, "cannot receive stream request: %v", err)
+}
 
-	// Block localhost and loopback addresses
-	if ip.IsLoopback() {
-		return false, "localhost/loopback address is blocked"
-	}
+// streamReset records a reset stream and returns the status to end it with.
+func streamReset(err error) error {
+	streamResetsTotal.Inc()
+	log.Debugf("Stream reset: %v", err)
+	return status.Error(codes.Canceled, "stream canceled")
+}
 
-	// Block unspecified addresses (0.0.0.0 or ::)
-	if ip.IsUnspecified() {
-		return false, "unspecified address is blocked"
+// phaseLabel names the phase of a processing message for metrics.
+func phaseLabel(req *extProcPb.ProcessingRequest) string {
+	switch req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestHeaders:
+		return string(PhaseRequestHeaders)
+	case *extProcPb.ProcessingRequest_RequestBody:
+		return "request_body"
+	case *extProcPb.ProcessingRequest_RequestTrailers:
+		return "request_trailers"
+	case *extProcPb.ProcessingRequest_ResponseHeaders:
+		return string(PhaseResponseHeaders)
+	case *extProcPb.ProcessingRequest_ResponseBody:
+		return "response_body"
+	case *extProcPb.ProcessingRequest_ResponseTrailers:
+		return "response_trailers"
+	default:
+		return "unknown"
 	}
+}
 
-	// Block link-local addresses (169.254.0.0/16 for IPv4, fe80::/10 for IPv6)
-	if ip.IsLinkLocalUnicast() {
-		return false, "link-local address is blocked"
+// decide answers a single processing request against the active config,
+// then records the decisions made for it and counts request decisions toward
+// Config.MaxRequests.
+func decide(ctx context.Context, stream *streamState, req *extProcPb.ProcessingRequest) *extProcPb.ProcessingResponse {
+	resp, _ := decideWith(ctx, activeConfig(), stream, req)
+	if _, ok := req.Request.(*extProcPb.ProcessingRequest_RequestHeaders); ok {
+		countDecision()
 	}
-
-	// Block multicast addresses
-	if ip.IsMulticast() {
-		return false, "multicast address is blocked"
+	for _, r := range stream.recorded {
+		recordDecision(r.upstreamIP, stream.requestID, r.headers, r.decision)
 	}
+	stream.recorded = stream.recorded[:0]
+	return resp
+}
 
-	// Block private network ranges
-	if ip.IsPrivate() {
-		return false, "private network address is blocked (RFC1918)"
-	}
+// decideWith evaluates a single processing request against cfg and returns
+// the response to send and the decision behind it. It only updates stream:
+// decisions to record are kept in stream.recorded rather than written to the
+// audit log and event sink, so Simulate can run it offline.
+func decideWith(ctx context.Context, cfg *Config, stream *streamState, req *extProcPb.ProcessingRequest) (*extProcPb.ProcessingResponse, Decision) {
+	switch v := req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestHeaders:
+		upstreamIP, source := extractUpstreamAddress(cfg, req.Attributes)
+		stream.upstreamIP = upstreamIP
+		stream.upstreamSource = source
+		stream.upstreamCluster = extractUpstreamCluster(cfg, req.Attributes)
+		stream.requestID = getHeader(v.RequestHeaders.Headers, requestIDHeader(cfg))
+		generatedID := stream.requestID == "" && cfg.GenerateRequestID
+		if generatedID {
+			stream.requestID = newRequestID()
+		}
+		decision := evaluate(ctx, cfg, req)
+
+		// Blocks are always logged, allows only when sampled.
+		logDetail := !decision.Allow || sampleLog(cfg)
+		if logDetail && cfg.LogRequestHeaders {
+			log.Printf("Request headers: %v", redactedHeaders(cfg, v.RequestHeaders.Headers))
+		}
+
+		stream.record(upstreamIP, v.RequestHeaders.Headers, decision)
+		if !decision.Allow && bypassRequested(cfg, v.RequestHeaders.Headers) {
+			stream.bypassed = true
+			decision = bypass(stream, upstreamIP, decision)
+		}
+		stream.requestDecision = &decision
+		stream.responseHeaders = responseHeadersFor(cfg, stream, decision)
+		if !decision.Allow {
+			log.Printf("BLOCKED: Upstream IP %s (from %s) - %s\n", upstreamIP, source, decision.ReasonText)
+
+			// Return immediate response that denies the request
+			resp := blockResponse(cfg, stream, decision, isGrpcRequest(v.RequestHeaders.Headers))
+			if cfg.DebugDecisionHeader {
+				immediate := resp.GetImmediateResponse()
+				immediate.Headers.SetHeaders = append(immediate.Headers.SetHeaders, decisionHeader(decision))
+			}
+			resp.DynamicMetadata = decisionMetadata(cfg, stream, decision)
+			return resp, decision
+		}
+
+		if logDetail {
+			log.Printf("ALLOWED: Upstream IP %s (from %s)\n", upstreamIP, source)
+		}
+
+		common := &extProcPb.CommonResponse{
+			Status: extProcPb.CommonResponse_CONTINUE,
+		}
+		markers := presentMarkerHeaders(cfg, v.RequestHeaders.Headers)
+		if cfg.DebugDecisionHeader || generatedID || len(markers) > 0 {
+			common.HeaderMutation = &extProcPb.HeaderMutation{}
+		}
+		// Signed tokens are for this processor only, don't hand them to the
+		// upstream.
+		if len(markers) > 0 {
+			common.HeaderMutation.RemoveHeaders = markers
+		}
+		if cfg.DebugDecisionHeader {
+			common.HeaderMutation.SetHeaders = append(common.HeaderMutation.SetHeaders, decisionHeader(decision))
+		}
+		if generatedID {
+			common.HeaderMutation.SetHeaders = append(common.HeaderMutation.SetHeaders, setHeader(requestIDHeader(cfg), stream.requestID))
+		}
+		common.Status = continueStatus(cfg, common.HeaderMutation)
+		// Mutated request headers may change the route, so have Envoy
+		// recompute it.
+		common.ClearRouteCache = common.Status == extProcPb.CommonResponse_CONTINUE_AND_REPLACE
+		return &extProcPb.ProcessingResponse{
+			Response: &extProcPb.ProcessingResponse_RequestHeaders{
+				RequestHeaders: &extProcPb.HeadersResponse{
+					Response: common,
+				},
+			},
+			DynamicMetadata: decisionMetadata(cfg, stream, decision),
+		}, decision
+
+	case *extProcPb.ProcessingRequest_ResponseHeaders:
+		decision := evaluate(ctx, cfg, req)
+		if !decision.Allow && stream.bypassed {
+			upstreamIP, _ := extractUpstreamAddress(cfg, req.Attributes)
+			stream.record(upstreamIP, v.ResponseHeaders.Headers, decision)
+			decision = bypass(stream, upstreamIP, decision)
+		}
+		if !decision.Allow {
+			log.Printf("BLOCKED: Response - %s\n", decision.ReasonText)
+			upstreamIP, _ := extractUpstreamAddress(cfg, req.Attributes)
+			stream.record(upstreamIP, v.ResponseHeaders.Headers, decision)
+			resp := blockResponse(cfg, stream, decision, isGrpcRequest(v.ResponseHeaders.Headers))
+			resp.DynamicMetadata = decisionMetadata(cfg, stream, decision)
+			return resp, decision
+		}
 
-	// Check for cloud metadata service IPs
-	// AWS metadata service: 169.254.169.254
-	if ipStr == "169.254.169.254" {
-		return false, "AWS metadata service IP is blocked"
+		common := &extProcPb.CommonResponse{
+			Status: extProcPb.CommonResponse_CONTINUE,
+		}
+		if remove := append(slices.Clip(cfg.ResponseRemoveHeaders), bodyInspectorHeaders(cfg)...); len(remove) > 0 {
+			common.HeaderMutation = &extProcPb.HeaderMutation{
+				RemoveHeaders: remove,
+			}
+		}
+		if rule := matchResponseStatus(cfg, v.ResponseHeaders.Headers); rule != nil && rule.Action == ResponseStatusAddHeader {
+			if common.HeaderMutation == nil {
+				common.HeaderMutation = &extProcPb.HeaderMutation{}
+			}
+			common.HeaderMutation.SetHeaders = append(common.HeaderMutation.SetHeaders, setHeader(rule.HeaderName, rule.HeaderValue))
+		}
+		if len(stream.responseHeaders) > 0 {
+			if common.HeaderMutation == nil {
+				common.HeaderMutation = &extProcPb.HeaderMutation{}
+			}
+			common.HeaderMutation.SetHeaders = append(common.HeaderMutation.SetHeaders, stream.responseHeaders...)
+		}
+		common.Status = continueStatus(cfg, common.HeaderMutation)
+		return &extProcPb.ProcessingResponse{
+			Response: &extProcPb.ProcessingResponse_ResponseHeaders{
+				ResponseHeaders: &extProcPb.HeadersResponse{
+					Response: common,
+				},
+			},
+		}, decision
+
+	case *extProcPb.ProcessingRequest_RequestBody, *extProcPb.ProcessingRequest_RequestTrailers,
+		*extProcPb.ProcessingRequest_ResponseBody, *extProcPb.ProcessingRequest_ResponseTrailers:
+		return decideBodyPhase(ctx, cfg, stream, req)
+
+	default:
+		log.Printf("Unexpected Request type %+v\n", v)
 	}
 
-	// GCP metadata service: 169.254.169.254 (same as AWS)
-	// Azure metadata service: 169.254.169.254 (same as AWS)
-	// All major cloud providers use the same IP
+	return nil, Decision{Allow: true, ReasonCode: ReasonPhaseNotEvaluated}
+}
 
-	// Additional IPv6 link-local checks for cloud metadata
-	// GCP also uses fd00:ec2::254
-	if ipStr == "fd00:ec2::254" {
-		return false, "GCP metadata service IPv6 is blocked"
+// decideBodyPhase answers a body or trailer message. Request bodies and
+// trailers only carry a verdict through the request header decision, so one
+// that arrives before any request headers, usually a filter processing_mode
+// misconfiguration, is handled as an extraction failure under
+// Config.FailureMode. Response bodies and trailers don't depend on it, the
+// filter may skip request headers altogether.
+func decideBodyPhase(ctx context.Context, cfg *Config, stream *streamState, req *extProcPb.ProcessingRequest) (*extProcPb.ProcessingResponse, Decision) {
+	if stream.requestDecision == nil && isRequestPhase(req) {
+		phase := phaseLabel(req)
+		log.Warnf("Received %s before request_headers, check the filter processing_mode", phase)
+		text := phase + " received before request headers"
+		var decision Decision
+		if cfg.FailureMode == FailureModeOpen {
+			decision = failOpen(ReasonExtraction, text)
+		} else {
+			decision = decisionForError(fmt.Errorf("%w: %s", ErrExtraction, text))
+		}
+		upstreamIP, _ := extractUpstreamAddress(cfg, req.Attributes)
+		stream.record(upstreamIP, nil, decision)
+		stream.requestDecision = &decision
+		if !decision.Allow {
+			resp := blockResponse(cfg, stream, decision, false)
+			resp.DynamicMetadata = decisionMetadata(cfg, stream, decision)
+			return resp, decision
+		}
 	}
 
-	// Block IPv4-mapped IPv6 addresses that map to blocked ranges
-	if ip.To4() == nil && ip.To16() != nil {
-		// Check if it's an IPv4-mapped IPv6 address
-		if strings.HasPrefix(ipStr, "::ffff:") {
-			// Extract the IPv4 part and check it
-			ipv4Part := strings.TrimPrefix(ipStr, "::ffff:")
-			if safe, reason := isUpstreamIPSafe(ipv4Part); !safe {
-				return false, fmt.Sprintf("IPv4-mapped IPv6 address blocked: %s", reason)
-			}
+	if d := stream.requestDecision; d != nil && !d.Allow {
+		return blockResponse(cfg, stream, *d, false), *d
+	}
+	notEvaluated := Decision{Allow: true, ReasonCode: ReasonPhaseNotEvaluated}
+	if exceedsBodyChunks(cfg, stream, req) {
+		if resp := bodyChunkLimit(cfg, stream, req); resp != nil {
+			return resp, stream.lastRecorded(notEvaluated)
 		}
 	}
+	if resp := inspectBody(ctx, cfg, stream, req); resp != nil {
+		return resp, stream.lastRecorded(notEvaluated)
+	}
+	if resp := replaceResponseBody(ctx, cfg, stream, req); resp != nil {
+		return resp, stream.lastRecorded(notEvaluated)
+	}
+	return continueResponse(req), stream.lastRecorded(notEvaluated)
+}
 
-	// Block documentation/example ranges
-	// IPv4: 192.0.2.0/24, 198.51.100.0/24, 203.0.113.0/24 (TEST-NET-1,2,3)
-	// IPv6: 2001:db8::/32 (documentation)
-	_, testNet1, _ := net.ParseCIDR("192.0.2.0/24")
-	_, testNet2, _ := net.ParseCIDR("198.51.100.0/24")
-	_, testNet3, _ := net.ParseCIDR("203.0.113.0/24")
-	_, testNet6, _ := net.ParseCIDR("2001:db8::/32")
+// isRequestPhase reports whether req is a request body or trailer message.
+func isRequestPhase(req *extProcPb.ProcessingRequest) bool {
+	switch req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestBody, *extProcPb.ProcessingRequest_RequestTrailers:
+		return true
+	default:
+		return false
+	}
+}
+
+// inspectBody runs the Decider chain on a body chunk with
+// Config.InspectBodies. Only a blocking verdict counts, the request already
+// has its verdict. It returns the block response, or nil to let the chunk
+// through.
+func inspectBody(ctx context.Context, cfg *Config, stream *streamState, req *extProcPb.ProcessingRequest) *extProcPb.ProcessingResponse {
+	if !cfg.InspectBodies {
+		return nil
+	}
+	trackBody(stream, req)
+	in := &DecisionInput{
+		Config:          cfg,
+		Attributes:      req.Attributes,
+		UpstreamCluster: stream.upstreamCluster,
+	}
+	in.UpstreamIP, in.UpstreamSource = extractUpstreamAddress(cfg, req.Attributes)
+	switch v := req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestBody:
+		in.Phase, in.Body, in.EndOfStream = PhaseRequestBody, v.RequestBody.Body, v.RequestBody.EndOfStream
+	case *extProcPb.ProcessingRequest_ResponseBody:
+		in.Phase, in.Body, in.EndOfStream = PhaseResponseBody, v.ResponseBody.Body, v.ResponseBody.EndOfStream
+	default:
+		return nil
+	}
 
-	if testNet1.Contains(ip) || testNet2.Contains(ip) || testNet3.Contains(ip) || testNet6.Contains(ip) {
-		return false, "documentation/test network range is blocked"
+	var decision Decision
+	for _, d := range deciders(cfg) {
+		verdict, err := d.Decide(ctx, in)
+		if errors.Is(err, ErrInconclusive) {
+			return inconclusiveBody(cfg, stream, in.UpstreamIP, fmt.Sprintf("%s: %v", in.Phase, err))
+		}
+		if err != nil {
+			decision = decisionForError(err)
+			break
+		}
+		if verdict != nil && !verdict.Allow {
+			decision = *verdict
+			break
+		}
+	}
+	if decision.Allow || decision.ReasonCode == "" {
+		return nil
 	}
 
-	// If all checks pass, the IP is considered safe
-	return true, ""
+	log.Printf("BLOCKED: %s - %s\n", in.Phase, decision.ReasonText)
+	stream.record(in.UpstreamIP, nil, decision)
+	resp := blockResponse(cfg, stream, decision, false)
+	resp.DynamicMetadata = decisionMetadata(cfg, stream, decision)
+	return resp
 }
 
-func (s *healthServer) Check(ctx context.Context, in *healthPb.HealthCheckRequest) (*healthPb.HealthCheckResponse, error) {
-	log.Printf("Handling grpc Check request + %s", in.String())
-	return &healthPb.HealthCheckResponse{Status: healthPb.HealthCheckResponse_SERVING}, nil
+// trackBody records whether a body is in progress in either direction, for
+// partialBody. Trailers end the body before them.
+func trackBody(stream *streamState, req *extProcPb.ProcessingRequest) {
+	switch v := req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestBody:
+		stream.requestBodyOpen = !v.RequestBody.EndOfStream
+	case *extProcPb.ProcessingRequest_RequestTrailers:
+		stream.requestBodyOpen = false
+	case *extProcPb.ProcessingRequest_ResponseBody:
+		stream.responseBodyOpen = !v.ResponseBody.EndOfStream
+	case *extProcPb.ProcessingRequest_ResponseTrailers:
+		stream.responseBodyOpen = false
+	}
 }
 
-func (s *healthServer) Watch(in *healthPb.HealthCheckRequest, srv healthPb.Health_WatchServer) error {
-	return status.Error(codes.Unimplemented, "Watch is not implemented")
+// inconclusiveBody applies Config.InconclusiveBody to a body decision a
+// Decider couldn't complete. It returns the block response, or nil to let the
+// chunk through.
+func inconclusiveBody(cfg *Config, stream *streamState, upstreamIP, text string) *extProcPb.ProcessingResponse {
+	action := cfg.InconclusiveBody
+	if action == "" {
+		action = InconclusiveBodyBlock
+	}
+	inconclusiveBodyTotal.WithLabelValues(action).Inc()
+	switch action {
+	case InconclusiveBodyAllow:
+		return nil
+	case InconclusiveBodyLog:
+		log.Warnf("Inconclusive body decision: %s, allowing", text)
+		return nil
+	}
+
+	decision := blocked(ReasonInconclusiveBody, text, "")
+	log.Printf("BLOCKED: %s\n", text)
+	stream.record(upstreamIP, nil, decision)
+	resp := blockResponse(cfg, stream, decision, false)
+	resp.DynamicMetadata = decisionMetadata(cfg, stream, decision)
+	return resp
 }
 
-// Demo Ext-Proc server
-func (s *server) Process(srv extProcPb.ExternalProcessor_ProcessServer) error {
-	ctx := srv.Context()
+// partialBody applies Config.InconclusiveBody to a stream that ended part way
+// through a body it was inspecting, e.g. because the connection dropped. The
+// chunks received have already been let through and nothing more can be sent
+// on the stream, so a block is only logged and recorded.
+func partialBody(stream *streamState) {
+	if !stream.requestBodyOpen && !stream.responseBodyOpen {
+		return
+	}
+	cfg := activeConfig()
+	action := cfg.InconclusiveBody
+	if action == "" {
+		action = InconclusiveBodyBlock
+	}
+	inconclusiveBodyTotal.WithLabelValues(action).Inc()
+	text := "stream ended before the end of the request body"
+	if stream.responseBodyOpen {
+		text = "stream ended before the end of the response body"
+	}
+	switch action {
+	case InconclusiveBodyAllow:
+		return
+	case InconclusiveBodyLog:
+		log.Warnf("Inconclusive body decision: %s, allowing", text)
+		return
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+	log.Warnf("Inconclusive body decision: %s, already forwarded", text)
+	recordDecision(stream.upstreamIP, stream.requestID, nil, blocked(ReasonInconclusiveBody, text, ""))
+}
 
-		req, err := srv.Recv()
-		if err == io.EOF {
-			return nil
-		} else if err != nil {
-			return status.Errorf(codes.Unknown, "cannot receive stream request: %v", err)
-		}
+// exceedsBodyChunks counts a body chunk against Config.MaxBodyChunks and
+// reports whether this chunk trips the limit.
+func exceedsBodyChunks(cfg *Config, stream *streamState, req *extProcPb.ProcessingRequest) bool {
+	if cfg.MaxBodyChunks <= 0 || stream.chunkLimitTripped {
+		return false
+	}
 
-		var resp *extProcPb.ProcessingResponse
-		upstreamIP := extractUpstreamIP(req.Attributes)
-		isSafe := false
-		reason := ""
+	var count *int
+	var body *extProcPb.HttpBody
+	switch v := req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestBody:
+		count, body = &stream.requestChunks, v.RequestBody
+	case *extProcPb.ProcessingRequest_ResponseBody:
+		count, body = &stream.responseChunks, v.ResponseBody
+	default:
+		return false
+	}
+	if body.GetEndOfStream() {
+		return false
+	}
+	*count++
+	if *count <= cfg.MaxBodyChunks {
+		return false
+	}
+	stream.chunkLimitTripped = true
+	return true
+}
 
-		if upstreamIP != "" {
-			log.Printf("Upstream IP Address: %s\n", upstreamIP)
+// bodyChunkLimit applies Config.BodyChunksExceeded to a stream over the body
+// chunk limit. It returns the block response, or nil to let the chunk through.
+func bodyChunkLimit(cfg *Config, stream *streamState, req *extProcPb.ProcessingRequest) *extProcPb.ProcessingResponse {
+	action := cfg.BodyChunksExceeded
+	if action == "" {
+		action = BodyChunksBlock
+	}
+	bodyChunkLimitTotal.WithLabelValues(action).Inc()
+
+	text := fmt.Sprintf("%s exceeded %d chunks without end of stream", phaseLabel(req), cfg.MaxBodyChunks)
+	switch action {
+	case BodyChunksAllow:
+		return nil
+	case BodyChunksLog:
+		log.Warnf("Body chunk limit: %s, allowing", text)
+		return nil
+	}
 
-			// Check if the upstream IP is safe
-			isSafe, reason = isUpstreamIPSafe(upstreamIP)
-		} else {
-			isSafe = false
-			reason = "unable to extract upstream IP address"
-		}
-
-		switch v := req.Request.(type) {
-		case *extProcPb.ProcessingRequest_RequestHeaders:
-			// Extract upstream IP address from attributes
-
-			if !isSafe {
-				log.Printf("BLOCKED: Upstream IP %s - %s\n", upstreamIP, reason)
-
-				// Return immediate response that denies the request
-				resp = &extProcPb.ProcessingResponse{
-					Response: &extProcPb.ProcessingResponse_ImmediateResponse{
-						ImmediateResponse: &extProcPb.ImmediateResponse{
-							Status: &typev3.HttpStatus{
-								Code: typev3.StatusCode_Forbidden,
-							},
-							Body: []byte(reason),
-						},
-					},
-					// Optionally, set dynamic metadata to indicate blocking
-					DynamicMetadata: &structpb.Struct{
-						Fields: map[string]*structpb.Value{
-							"blocked": structpb.NewBoolValue(true),
-							"reason":  structpb.NewStringValue(reason),
-						},
-					},
-				}
-			} else {
-				log.Printf("ALLOWED: Upstream IP %s\n", upstreamIP)
-				resp = &extProcPb.ProcessingResponse{
-					Response: &extProcPb.ProcessingResponse_RequestHeaders{
-						RequestHeaders: &extProcPb.HeadersResponse{
-							Response: &extProcPb.CommonResponse{
-								Status: extProcPb.CommonResponse_CONTINUE,
-							},
-						},
-					},
-				}
-			}
+	decision := blocked(ReasonBodyChunkLimit, text, "max-body-chunks")
+	decision.StatusCode = http.StatusRequestEntityTooLarge
+	log.Printf("BLOCKED: %s\n", text)
+	upstreamIP, _ := extractUpstreamAddress(cfg, req.Attributes)
+	stream.record(upstreamIP, nil, decision)
+	resp := blockResponse(cfg, stream, decision, false)
+	resp.DynamicMetadata = decisionMetadata(cfg, stream, decision)
+	return resp
+}
 
-		default:
-			log.Printf("Unexpected Request type %+v\n", v)
+// continueResponse lets a body or trailer message through unchanged.
+func continueResponse(req *extProcPb.ProcessingRequest) *extProcPb.ProcessingResponse {
+	body := &extProcPb.BodyResponse{
+		Response: &extProcPb.CommonResponse{Status: extProcPb.CommonResponse_CONTINUE},
+	}
+	switch req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestBody:
+		return &extProcPb.ProcessingResponse{
+			Response: &extProcPb.ProcessingResponse_RequestBody{RequestBody: body},
 		}
-
-		if err := srv.Send(resp); err != nil {
-			log.Printf("send error %v", err)
+	case *extProcPb.ProcessingRequest_ResponseBody:
+		return &extProcPb.ProcessingResponse{
+			Response: &extProcPb.ProcessingResponse_ResponseBody{ResponseBody: body},
+		}
+	case *extProcPb.ProcessingRequest_RequestTrailers:
+		return &extProcPb.ProcessingResponse{
+			Response: &extProcPb.ProcessingResponse_RequestTrailers{RequestTrailers: &extProcPb.TrailersResponse{}},
+		}
+	default:
+		return &extProcPb.ProcessingResponse{
+			Response: &extProcPb.ProcessingResponse_ResponseTrailers{ResponseTrailers: &extProcPb.TrailersResponse{}},
 		}
 	}
 }
 
+// recordDecision keeps a decision for the debug endpoints and the audit log.
+func recordDecision(upstreamIP, requestID string, headers *corev3.HeaderMap, decision Decision) {
+	now := time.Now()
+
+	if !decision.Allow {
+		recentBlocks.add(blockRecord{
+			Time:       now,
+			UpstreamIP: upstreamIP,
+			ReasonCode: decision.ReasonCode,
+			Reason:     decision.ReasonText,
+			RequestID:  requestID,
+		})
+	}
+
+	event := Event{
+		Time:        now,
+		Allowed:     decision.Allow,
+		UpstreamIP:  upstreamIP,
+		ReasonCode:  decision.ReasonCode,
+		Reason:      decision.ReasonText,
+		MatchedRule: decision.MatchedRule,
+		RequestID:   requestID,
+		Authority:   getHeader(headers, ":authority"),
+	}
+	if !decision.Allow && sampleForensics(config, decision.ReasonCode) {
+		event.Headers = redactedHeaders(config, headers)
+	}
+	if !decision.Allow || config.AuditAllowed {
+		audit.write(event)
+	}
+	if !decision.Allow || config.EventSinkAllowed {
+		events.send(event)
+	}
+}
+
+// sampleForensics reports whether a block with this reason code should carry
+// a header dump.
+func sampleForensics(cfg *Config, code ReasonCode) bool {
+	rate := cfg.ForensicCaptureRates[string(code)]
+	return rate >= 1 || (rate > 0 && rand.Float64() < rate)
+}
+
+// sampleLog reports whether an allowed decision should be logged in detail.
+func sampleLog(cfg *Config) bool {
+	return cfg.LogSampleRate >= 1 || rand.Float64() < cfg.LogSampleRate
+}
+
 // Run entry point for Envoy XDS command line.
 func Run() error {
-	grpcServer := grpc.NewServer()
-	reflection.Register(grpcServer)
-	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", config.Port))
+	opts := []grpc.ServerOption{grpc.ChainStreamInterceptor(limitStreams, recoverStream)}
+	if certs != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(certs.tlsConfig())))
+	}
+	grpcServer := grpc.NewServer(opts...)
+	if config.EnableReflection {
+		reflection.Register(grpcServer)
+	}
+	listeners, err := listen()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	extProcPb.RegisterExternalProcessorServer(grpcServer, &server{})
-	healthPb.RegisterHealthServer(grpcServer, &healthServer{})
+	if config.EnableHealthService {
+		healthPb.RegisterHealthServer(grpcServer, &healthServer{})
+	}
 
+	debugServer := newDebugServer()
+	if debugServer != nil {
+		go func() {
+			if err := debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		log.Infof("Debug endpoints listening on %s", debugServer.Addr)
+	}
+
+	readyAt.Store(time.Now().Add(config.StartupGracePeriod).UnixNano())
+	if config.StartupGracePeriod > 0 {
+		log.Infof("Readiness held for a %s startup grace period", config.StartupGracePeriod)
+	}
+	for _, lis := range listeners {
+		go func(lis net.Listener) {
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatal(err)
+			}
+		}(lis)
+		log.Infof("Listening on %s", lis.Addr())
+	}
+
+	// SIGHUP reopens log files for rotation
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		if err = grpcServer.Serve(lis); err != nil {
-			log.Fatal(err)
+		for range hup {
+			audit.reopen()
+			geoIP.reopen()
+			certs.reload()
 		}
 	}()
 
-	log.Infof("Listening on %d", config.Port)
-
 	// Wait for CTRL-c shutdown
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
-	<-done
+	select {
+	case <-done:
+	case <-recycle:
+	}
+	shuttingDown.Store(true)
 
+	if debugServer != nil {
+		debugServer.Close()
+	}
 	grpcServer.GracefulStop()
+	workers.close()
+	audit.close()
+	events.close()
+	geoIP.close()
+	policy.close()
+	certs.close()
 	log.Info("Shutdown")
 	return nil
 }
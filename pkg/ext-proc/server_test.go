@@ -0,0 +1,580 @@
+package extproc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeProcessStream is an ExternalProcessor_ProcessServer over channels.
+// Recv returns io.EOF once recv is closed and drained.
+type fakeProcessStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *extProcPb.ProcessingRequest
+	sent chan *extProcPb.ProcessingResponse
+}
+
+func newFakeProcessStream(ctx context.Context, reqs ...*extProcPb.ProcessingRequest) *fakeProcessStream {
+	s := &fakeProcessStream{
+		ctx:  ctx,
+		recv: make(chan *extProcPb.ProcessingRequest, len(reqs)),
+		sent: make(chan *extProcPb.ProcessingResponse, len(reqs)),
+	}
+	for _, req := range reqs {
+		s.recv <- req
+	}
+	close(s.recv)
+	return s
+}
+
+func (s *fakeProcessStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeProcessStream) Recv() (*extProcPb.ProcessingRequest, error) {
+	select {
+	case req, ok := <-s.recv:
+		if !ok {
+			return nil, io.EOF
+		}
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *fakeProcessStream) Send(resp *extProcPb.ProcessingResponse) error {
+	s.sent <- resp
+	return nil
+}
+
+// useConfig validates cfg and makes it the package config for the test.
+func useConfig(t testing.TB, cfg *Config) *Config {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	prev := config
+	config = cfg
+	policyConfig.Store(nil)
+	t.Cleanup(func() { config = prev })
+	return cfg
+}
+
+// runStream sends reqs through Process as one stream and returns the
+// responses it sent, in order.
+func runStream(t *testing.T, reqs ...*extProcPb.ProcessingRequest) []*extProcPb.ProcessingResponse {
+	t.Helper()
+	srv := newFakeProcessStream(context.Background(), reqs...)
+	if err := (&server{}).Process(srv); err != nil {
+		t.Fatalf("Process() = %v", err)
+	}
+	close(srv.sent)
+	var out []*extProcPb.ProcessingResponse
+	for resp := range srv.sent {
+		out = append(out, resp)
+	}
+	return out
+}
+
+// upstreamAttributes returns ext_proc attributes carrying addr as the
+// upstream address.
+func upstreamAttributes(addr string) map[string]*structpb.Struct {
+	return map[string]*structpb.Struct{
+		extProcAttributes: {Fields: map[string]*structpb.Value{
+			defaultAttributePath: structpb.NewStringValue(addr),
+		}},
+	}
+}
+
+func headerMap(kv ...string) *corev3.HeaderMap {
+	m := &corev3.HeaderMap{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		m.Headers = append(m.Headers, &corev3.HeaderValue{Key: kv[i], Value: kv[i+1]})
+	}
+	return m
+}
+
+func requestHeaders(addr string, kv ...string) *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{
+		Request: &extProcPb.ProcessingRequest_RequestHeaders{
+			RequestHeaders: &extProcPb.HttpHeaders{Headers: headerMap(kv...)},
+		},
+		Attributes: upstreamAttributes(addr),
+	}
+}
+
+func requestBody(body string, endOfStream bool) *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{
+		Request: &extProcPb.ProcessingRequest_RequestBody{
+			RequestBody: &extProcPb.HttpBody{Body: []byte(body), EndOfStream: endOfStream},
+		},
+	}
+}
+
+func requestTrailers() *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{
+		Request: &extProcPb.ProcessingRequest_RequestTrailers{
+			RequestTrailers: &extProcPb.HttpTrailers{},
+		},
+	}
+}
+
+func responseHeaders(kv ...string) *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{
+		Request: &extProcPb.ProcessingRequest_ResponseHeaders{
+			ResponseHeaders: &extProcPb.HttpHeaders{Headers: headerMap(kv...)},
+		},
+	}
+}
+
+func responseBody(body string, endOfStream bool) *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{
+		Request: &extProcPb.ProcessingRequest_ResponseBody{
+			ResponseBody: &extProcPb.HttpBody{Body: []byte(body), EndOfStream: endOfStream},
+		},
+	}
+}
+
+func responseTrailers() *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{
+		Request: &extProcPb.ProcessingRequest_ResponseTrailers{
+			ResponseTrailers: &extProcPb.HttpTrailers{},
+		},
+	}
+}
+
+// immediateStatus returns the status of an immediate response, or 0 if resp
+// isn't one.
+func immediateStatus(resp *extProcPb.ProcessingResponse) typev3.StatusCode {
+	return resp.GetImmediateResponse().GetStatus().GetCode()
+}
+
+// mutationHeaders flattens the headers a mutation sets.
+func mutationHeaders(m *extProcPb.HeaderMutation) map[string]string {
+	out := map[string]string{}
+	for _, h := range m.GetSetHeaders() {
+		out[h.GetHeader().GetKey()] = string(h.GetHeader().GetRawValue())
+	}
+	return out
+}
+
+func TestProcessAllowedStream(t *testing.T) {
+	useConfig(t, &Config{})
+
+	resps := runStream(t,
+		requestHeaders("93.184.216.34:443", ":authority", "example.com", ":method", "POST"),
+		requestBody("hello", false),
+		requestBody("world", true),
+		requestTrailers(),
+		responseHeaders(":status", "200"),
+		responseBody("ok", true),
+		responseTrailers(),
+	)
+	if len(resps) != 7 {
+		t.Fatalf("got %d responses, want 7", len(resps))
+	}
+	if got := resps[0].GetRequestHeaders().GetResponse().GetStatus(); got != extProcPb.CommonResponse_CONTINUE {
+		t.Errorf("request headers status = %v, want CONTINUE", got)
+	}
+	for _, resp := range resps[1:3] {
+		if got := resp.GetRequestBody().GetResponse().GetStatus(); resp.GetRequestBody() == nil || got != extProcPb.CommonResponse_CONTINUE {
+			t.Errorf("request body response = %v, want CONTINUE", resp)
+		}
+	}
+	if resps[3].GetRequestTrailers() == nil {
+		t.Errorf("request trailers response = %v, want trailers response", resps[3])
+	}
+	if got := resps[4].GetResponseHeaders().GetResponse().GetStatus(); resps[4].GetResponseHeaders() == nil || got != extProcPb.CommonResponse_CONTINUE {
+		t.Errorf("response headers response = %v, want CONTINUE", resps[4])
+	}
+	if resps[5].GetResponseBody() == nil {
+		t.Errorf("response body response = %v, want CONTINUE", resps[5])
+	}
+	if resps[6].GetResponseTrailers() == nil {
+		t.Errorf("response trailers response = %v, want trailers response", resps[6])
+	}
+}
+
+func TestProcessBlockedStream(t *testing.T) {
+	useConfig(t, &Config{})
+
+	resps := runStream(t,
+		requestHeaders("10.0.0.1:8080", ":authority", "internal"),
+		requestBody("payload", true),
+		requestTrailers(),
+	)
+	if len(resps) != 3 {
+		t.Fatalf("got %d responses, want 3", len(resps))
+	}
+	for i, resp := range resps {
+		if got := immediateStatus(resp); got != typev3.StatusCode_Forbidden {
+			t.Errorf("response %d status = %v, want Forbidden", i, got)
+		}
+	}
+	if got := string(resps[0].GetImmediateResponse().GetBody()); got == "" {
+		t.Error("block response has no body")
+	}
+	if resps[0].GetDynamicMetadata() == nil {
+		t.Error("block response has no decision metadata")
+	}
+}
+
+func TestProcessBlockedGrpcStream(t *testing.T) {
+	useConfig(t, &Config{})
+
+	resps := runStream(t, requestHeaders("127.0.0.1:50051", "content-type", "application/grpc"))
+	if len(resps) != 1 {
+		t.Fatalf("got %d responses, want 1", len(resps))
+	}
+	immediate := resps[0].GetImmediateResponse()
+	if immediate.GetStatus().GetCode() != typev3.StatusCode_OK {
+		t.Errorf("gRPC block status = %v, want OK", immediate.GetStatus().GetCode())
+	}
+	headers := mutationHeaders(immediate.GetHeaders())
+	if headers["grpc-status"] != "7" {
+		t.Errorf("grpc-status = %q, want 7", headers["grpc-status"])
+	}
+}
+
+func TestProcessBodyInspectionBlocks(t *testing.T) {
+	useConfig(t, &Config{
+		InspectBodies: true,
+		Deciders: []Decider{DeciderFunc(func(ctx context.Context, in *DecisionInput) (*Decision, error) {
+			if in.Phase == PhaseRequestBody && string(in.Body) == "evil" {
+				d := blocked(ReasonDeciderError, "bad body", "body")
+				return &d, nil
+			}
+			return &Decision{Allow: true, ReasonCode: ReasonAllowed}, nil
+		})},
+	})
+
+	resps := runStream(t,
+		requestHeaders("93.184.216.34:443"),
+		requestBody("fine", false),
+		requestBody("evil", true),
+	)
+	if len(resps) != 3 {
+		t.Fatalf("got %d responses, want 3", len(resps))
+	}
+	if resps[1].GetRequestBody() == nil {
+		t.Errorf("first chunk response = %v, want CONTINUE", resps[1])
+	}
+	if got := immediateStatus(resps[2]); got != typev3.StatusCode_Forbidden {
+		t.Errorf("second chunk status = %v, want Forbidden", got)
+	}
+}
+
+func TestProcessRequestBodyBeforeHeaders(t *testing.T) {
+	useConfig(t, &Config{})
+
+	resps := runStream(t, requestBody("payload", true), requestTrailers())
+	for i, resp := range resps {
+		if got := immediateStatus(resp); got != typev3.StatusCode_Forbidden {
+			t.Errorf("response %d status = %v, want Forbidden", i, got)
+		}
+	}
+	if got := resps[0].GetImmediateResponse().GetDetails(); !strings.Contains(got, string(ReasonExtraction)) {
+		t.Errorf("details = %q, want %s", got, ReasonExtraction)
+	}
+}
+
+func TestProcessRequestBodyBeforeHeadersFailOpen(t *testing.T) {
+	useConfig(t, &Config{FailureMode: FailureModeOpen})
+
+	resps := runStream(t, requestBody("payload", true), requestTrailers())
+	if resps[0].GetRequestBody() == nil {
+		t.Errorf("request body response = %v, want CONTINUE", resps[0])
+	}
+	if resps[1].GetRequestTrailers() == nil {
+		t.Errorf("request trailers response = %v, want trailers response", resps[1])
+	}
+}
+
+func TestProcessResponseOnlyStream(t *testing.T) {
+	// request_header_mode: SKIP, only the response is sent.
+	useConfig(t, &Config{})
+
+	resps := runStream(t,
+		responseHeaders(":status", "200"),
+		responseBody("ok", true),
+		responseTrailers(),
+	)
+	if resps[0].GetResponseHeaders() == nil {
+		t.Errorf("response headers response = %v, want CONTINUE", resps[0])
+	}
+	if resps[1].GetResponseBody() == nil {
+		t.Errorf("response body response = %v, want CONTINUE", resps[1])
+	}
+	if resps[2].GetResponseTrailers() == nil {
+		t.Errorf("response trailers response = %v, want trailers response", resps[2])
+	}
+}
+
+// needsFullBody is a Decider that can only decide on a complete request
+// body. It defers on streamed chunks and reports a partially buffered body,
+// marked by the "partial:" prefix here, as inconclusive.
+var needsFullBody = DeciderFunc(func(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	switch {
+	case in.Phase == PhaseRequestHeaders, in.Phase == PhaseResponseHeaders:
+		return &Decision{Allow: true, ReasonCode: ReasonAllowed}, nil
+	case in.Phase != PhaseRequestBody:
+		return nil, nil
+	case strings.HasPrefix(string(in.Body), "partial:"):
+		return nil, fmt.Errorf("%w: body exceeded the buffer", ErrInconclusive)
+	default:
+		return nil, nil
+	}
+})
+
+func TestProcessInconclusiveBody(t *testing.T) {
+	tests := []struct {
+		action string
+		want   typev3.StatusCode
+	}{
+		{"", typev3.StatusCode_Forbidden},
+		{InconclusiveBodyBlock, typev3.StatusCode_Forbidden},
+		{InconclusiveBodyAllow, 0},
+		{InconclusiveBodyLog, 0},
+	}
+	for _, tt := range tests {
+		useConfig(t, &Config{InspectBodies: true, InconclusiveBody: tt.action, Deciders: []Decider{needsFullBody}})
+		resps := runStream(t, requestHeaders("93.184.216.34:443"), requestBody("partial:abc", false))
+		if got := immediateStatus(resps[1]); got != tt.want {
+			t.Errorf("%q: status = %v, want %v", tt.action, got, tt.want)
+		}
+		if tt.want != 0 && !strings.Contains(resps[1].GetImmediateResponse().GetDetails(), string(ReasonInconclusiveBody)) {
+			t.Errorf("%q: details = %q, want %s", tt.action, resps[1].GetImmediateResponse().GetDetails(), ReasonInconclusiveBody)
+		}
+	}
+}
+
+func TestProcessPartialBodyStream(t *testing.T) {
+	tests := []struct {
+		action   string
+		reqs     []*extProcPb.ProcessingRequest
+		recorded bool
+	}{
+		{"", []*extProcPb.ProcessingRequest{requestHeaders("93.184.216.34:443"), requestBody("abc", false)}, true},
+		{InconclusiveBodyLog, []*extProcPb.ProcessingRequest{requestHeaders("93.184.216.34:443"), requestBody("abc", false)}, false},
+		{"", []*extProcPb.ProcessingRequest{requestHeaders("93.184.216.34:443"), requestBody("abc", true)}, false},
+		{"", []*extProcPb.ProcessingRequest{requestHeaders("93.184.216.34:443"), requestBody("abc", false), requestTrailers()}, false},
+		{"", []*extProcPb.ProcessingRequest{requestHeaders("93.184.216.34:443"), responseHeaders(":status", "200"), responseBody("abc", false)}, true},
+	}
+	prev := recentBlocks
+	t.Cleanup(func() { recentBlocks = prev })
+	for i, tt := range tests {
+		useConfig(t, &Config{InspectBodies: true, InconclusiveBody: tt.action, Deciders: []Decider{needsFullBody}})
+		recentBlocks = newBlockRing(10)
+
+		// Every chunk is let through, the stream ends without the rest.
+		resps := runStream(t, tt.reqs...)
+		for _, resp := range resps {
+			if immediateStatus(resp) != 0 {
+				t.Errorf("case %d: got immediate response %v", i, resp)
+			}
+		}
+		blocks := recentBlocks.list()
+		if recorded := len(blocks) == 1 && blocks[0].ReasonCode == ReasonInconclusiveBody; recorded != tt.recorded {
+			t.Errorf("case %d: recorded blocks %+v, want inconclusive recorded %v", i, blocks, tt.recorded)
+		}
+	}
+}
+
+func TestProcessContinueAndReplace(t *testing.T) {
+	const (
+		cont    = extProcPb.CommonResponse_CONTINUE
+		replace = extProcPb.CommonResponse_CONTINUE_AND_REPLACE
+	)
+	tests := []struct {
+		name         string
+		cfg          *Config
+		wantRequest  extProcPb.CommonResponse_ResponseStatus
+		wantResponse extProcPb.CommonResponse_ResponseStatus
+	}{
+		{"off", &Config{DebugDecisionHeader: true, ResponseRemoveHeaders: []string{"server"}}, cont, cont},
+		{"no mutation", &Config{ContinueAndReplace: true}, cont, cont},
+		{"request mutation", &Config{ContinueAndReplace: true, GenerateRequestID: true}, replace, cont},
+		{"response mutation", &Config{ContinueAndReplace: true, ResponseRemoveHeaders: []string{"server"}}, cont, replace},
+		{"both mutated", &Config{ContinueAndReplace: true, DebugDecisionHeader: true}, replace, replace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.cfg)
+			resps := runStream(t, requestHeaders("93.184.216.34:443"), responseHeaders(":status", "200"))
+			if len(resps) != 2 {
+				t.Fatalf("got %d responses, want 2", len(resps))
+			}
+
+			req := resps[0].GetRequestHeaders().GetResponse()
+			if req.GetStatus() != tt.wantRequest {
+				t.Errorf("request headers status = %v, want %v", req.GetStatus(), tt.wantRequest)
+			}
+			// Only a replaced request recomputes the route.
+			if want := tt.wantRequest == replace; req.GetClearRouteCache() != want {
+				t.Errorf("request headers clear_route_cache = %v, want %v", req.GetClearRouteCache(), want)
+			}
+
+			resp := resps[1].GetResponseHeaders().GetResponse()
+			if resp.GetStatus() != tt.wantResponse {
+				t.Errorf("response headers status = %v, want %v", resp.GetStatus(), tt.wantResponse)
+			}
+			if resp.GetClearRouteCache() {
+				t.Error("response headers clear the route cache")
+			}
+		})
+	}
+}
+
+func TestProcessRequestAndResponseMutations(t *testing.T) {
+	useConfig(t, &Config{
+		AllowedCIDRs:          []string{"93.184.216.0/24"},
+		GenerateRequestID:     true,
+		EchoRequestID:         true,
+		ResponseVerdictHeader: "x-upstream-verdict",
+	})
+	const verdict = "ALLOWED_CIDR; rule=93.184.216.0/24"
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		resps := runStream(t,
+			requestHeaders("93.184.216.34:443", ":method", "POST"),
+			requestBody("payload", true),
+			requestTrailers(),
+			responseHeaders(":status", "200"),
+			responseBody("ok", true),
+			responseTrailers(),
+		)
+		if len(resps) != 6 {
+			t.Fatalf("got %d responses, want 6", len(resps))
+		}
+
+		reqSet := mutationHeaders(resps[0].GetRequestHeaders().GetResponse().GetHeaderMutation())
+		id := reqSet["x-request-id"]
+		if id == "" {
+			t.Fatalf("request mutation = %v, want a generated x-request-id", reqSet)
+		}
+		ids = append(ids, id)
+
+		respSet := mutationHeaders(resps[3].GetResponseHeaders().GetResponse().GetHeaderMutation())
+		if respSet["x-request-id"] != id {
+			t.Errorf("response x-request-id = %q, want the request's %q", respSet["x-request-id"], id)
+		}
+		if respSet["x-upstream-verdict"] != verdict {
+			t.Errorf("response x-upstream-verdict = %q, want %q", respSet["x-upstream-verdict"], verdict)
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("both streams got request id %q, want one per stream", ids[0])
+	}
+
+	// A received id is echoed as is and the request is left alone.
+	resps := runStream(t,
+		requestHeaders("93.184.216.34:443", "x-request-id", "abc-123"),
+		responseHeaders(":status", "200"),
+	)
+	if m := resps[0].GetRequestHeaders().GetResponse().GetHeaderMutation(); m != nil {
+		t.Errorf("request mutation = %v, want none", m)
+	}
+	respSet := mutationHeaders(resps[1].GetResponseHeaders().GetResponse().GetHeaderMutation())
+	if respSet["x-request-id"] != "abc-123" || respSet["x-upstream-verdict"] != verdict {
+		t.Errorf("response mutation = %v, want the received id and verdict", respSet)
+	}
+}
+
+// redactSecrets is a BodyInspector that replaces any chunk mentioning a
+// secret.
+var redactSecrets = BodyInspectorFunc(func(ctx context.Context, in *DecisionInput) (*BodyVerdict, error) {
+	if strings.Contains(string(in.Body), "secret") {
+		return &BodyVerdict{Replace: true, Body: []byte("[redacted]"), ReasonText: "response leaked a secret"}, nil
+	}
+	return nil, nil
+})
+
+func TestProcessResponseBodyReplaced(t *testing.T) {
+	useConfig(t, &Config{BodyInspectors: []BodyInspector{redactSecrets}})
+
+	bodyMutation := func(resp *extProcPb.ProcessingResponse) *extProcPb.CommonResponse {
+		t.Helper()
+		if resp.GetResponseBody() == nil {
+			t.Fatalf("response = %v, want a response body response", resp)
+		}
+		return resp.GetResponseBody().GetResponse()
+	}
+
+	t.Run("buffered", func(t *testing.T) {
+		resps := runStream(t,
+			requestHeaders("93.184.216.34:443"),
+			responseHeaders(":status", "200", "content-length", "18"),
+			responseBody("the secret is 1234", true),
+		)
+		if len(resps) != 3 {
+			t.Fatalf("got %d responses, want 3", len(resps))
+		}
+		if got := resps[1].GetResponseHeaders().GetResponse().GetHeaderMutation().GetRemoveHeaders(); !slices.Contains(got, "content-length") {
+			t.Errorf("response headers remove %v, want content-length", got)
+		}
+		common := bodyMutation(resps[2])
+		if got := string(common.GetBodyMutation().GetBody()); got != "[redacted]" {
+			t.Errorf("body = %q, want the replacement", got)
+		}
+		if got := mutationHeaders(common.GetHeaderMutation())["content-length"]; got != "10" {
+			t.Errorf("content-length = %q, want 10", got)
+		}
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		resps := runStream(t,
+			requestHeaders("93.184.216.34:443"),
+			responseHeaders(":status", "200"),
+			responseBody("hello ", false),
+			responseBody("the secret ", false),
+			responseBody("is 1234", false),
+			responseBody("", true),
+			responseTrailers(),
+		)
+		if len(resps) != 7 {
+			t.Fatalf("got %d responses, want 7", len(resps))
+		}
+		if m := bodyMutation(resps[2]).GetBodyMutation(); m != nil {
+			t.Errorf("first chunk mutation = %v, want none", m)
+		}
+		common := bodyMutation(resps[3])
+		if got := string(common.GetBodyMutation().GetBody()); got != "[redacted]" {
+			t.Errorf("matching chunk = %q, want the replacement", got)
+		}
+		// The headers have gone out, only the body can change.
+		if common.GetHeaderMutation() != nil {
+			t.Errorf("streamed replacement mutates headers: %v", common.GetHeaderMutation())
+		}
+		for _, resp := range resps[4:6] {
+			if !bodyMutation(resp).GetBodyMutation().GetClearBody() {
+				t.Errorf("chunk after the replacement = %v, want it cleared", resp)
+			}
+		}
+		if resps[6].GetResponseTrailers() == nil {
+			t.Errorf("response trailers response = %v", resps[6])
+		}
+	})
+
+	t.Run("clean", func(t *testing.T) {
+		resps := runStream(t,
+			requestHeaders("93.184.216.34:443"),
+			responseHeaders(":status", "200"),
+			responseBody("nothing to see", true),
+		)
+		if m := bodyMutation(resps[2]).GetBodyMutation(); m != nil {
+			t.Errorf("body mutation = %v, want none", m)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package extproc
+
+import (
+	"context"
+	"math"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"golang.org/x/time/rate"
+)
+
+// streamState is the state kept for a single Process stream.
+type streamState struct {
+	// start is when the stream was opened.
+	start time.Time
+	// requestDecision is the verdict from the request header phase.
+	requestDecision *Decision
+	// upstreamIP is the upstream address from the request header phase, as
+	// reported by Envoy.
+	upstreamIP string
+	// upstreamSource is the attribute source the upstream address was read
+	// from in the request header phase.
+	upstreamSource string
+	// upstreamCluster is the cluster the request was routed to, if known.
+	upstreamCluster string
+	// requestID is the request id header value, or the one generated for
+	// Config.GenerateRequestID.
+	requestID string
+	// bypassed is set when a valid Config.BypassHeader token downgraded the
+	// stream to dry-run.
+	bypassed bool
+	// responseHeaders are set on the upstream response in the response
+	// header phase, derived from the request decision.
+	responseHeaders []*corev3.HeaderValueOption
+	// requestChunks and responseChunks count body chunks received without
+	// end of stream, for Config.MaxBodyChunks.
+	requestChunks, responseChunks int
+	// chunkLimitTripped stops the counting once the limit has been applied.
+	chunkLimitTripped bool
+	// requestBodyOpen and responseBodyOpen are set while Config.InspectBodies
+	// has seen part of that body but not its end.
+	requestBodyOpen, responseBodyOpen bool
+	// responseBodyStarted is set while a response body is part way through,
+	// for Config.BodyInspectors to tell a whole body from a chunk.
+	responseBodyStarted bool
+	// responseBodyReplaced is set once a streamed response body chunk has
+	// been replaced, so the rest of the body is cleared.
+	responseBodyReplaced bool
+	// recorded are the decisions made while answering the current message,
+	// for decide to record once it has been answered.
+	recorded []recordedDecision
+	// limiter paces messages for Config.PerStreamMsgRate, nil when unlimited.
+	limiter *rate.Limiter
+	// throttled is set once the stream has had to wait for the limiter.
+	throttled bool
+}
+
+// recordedDecision is a decision kept for recordDecision.
+type recordedDecision struct {
+	upstreamIP string
+	headers    *corev3.HeaderMap
+	decision   Decision
+}
+
+// record keeps a decision made for the current message for recordDecision.
+func (s *streamState) record(upstreamIP string, headers *corev3.HeaderMap, decision Decision) {
+	s.recorded = append(s.recorded, recordedDecision{upstreamIP: upstreamIP, headers: headers, decision: decision})
+}
+
+// lastRecorded returns the last decision recorded for the current message, or
+// fallback when there is none.
+func (s *streamState) lastRecorded(fallback Decision) Decision {
+	if len(s.recorded) == 0 {
+		return fallback
+	}
+	return s.recorded[len(s.recorded)-1].decision
+}
+
+func newStreamState() *streamState {
+	s := &streamState{start: time.Now()}
+	if config != nil && config.PerStreamMsgRate > 0 {
+		burst := int(math.Max(1, math.Ceil(config.PerStreamMsgRate)))
+		s.limiter = rate.NewLimiter(rate.Limit(config.PerStreamMsgRate), burst)
+	}
+	return s
+}
+
+// throttle waits until the stream may process another message under
+// Config.PerStreamMsgRate. It returns early with an error if ctx ends first.
+func (s *streamState) throttle(ctx context.Context) error {
+	if s.limiter == nil {
+		return nil
+	}
+	if s.limiter.Allow() {
+		return nil
+	}
+	if !s.throttled {
+		s.throttled = true
+		throttledStreamsTotal.Inc()
+	}
+	return s.limiter.Wait(ctx)
+}
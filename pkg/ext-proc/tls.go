@@ -0,0 +1,195 @@
+package extproc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// serverCerts holds the gRPC listener's certificate and client CA pool,
+// reloaded when the files change. It is safe for concurrent use, and a nil
+// *serverCerts means plaintext.
+type serverCerts struct {
+	certFile, keyFile, caFile string
+	// allowedIDs and allowedDNSNames restrict which client certificates are
+	// accepted, empty to accept any the CA signed.
+	allowedIDs, allowedDNSNames []string
+	// minVersion and cipherSuites are Config.TLSMinVersion and
+	// TLSCipherSuites, parsed.
+	minVersion   uint16
+	cipherSuites []uint16
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+
+	watcher *fileWatcher
+}
+
+// openServerCerts loads Config.TLSCert, TLSKey and TLSCA and starts watching
+// them, or returns nil when TLS isn't configured.
+func openServerCerts(c *Config) (*serverCerts, error) {
+	if c.TLSCert == "" {
+		return nil, nil
+	}
+	s := &serverCerts{
+		certFile:        c.TLSCert,
+		keyFile:         c.TLSKey,
+		caFile:          c.TLSCA,
+		allowedIDs:      c.TLSAllowedSPIFFEIDs,
+		allowedDNSNames: c.TLSAllowedDNSNames,
+		minVersion:      c.compiled.tlsMinVersion,
+		cipherSuites:    c.compiled.tlsCipherSuites,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	files := []string{s.certFile, s.keyFile}
+	if s.caFile != "" {
+		files = append(files, s.caFile)
+	}
+	var err error
+	if s.watcher, err = watchFiles(files, s.reload); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *serverCerts) load() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("TLS certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if s.caFile != "" {
+		pem, err := os.ReadFile(s.caFile)
+		if err != nil {
+			return fmt.Errorf("TLS CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("TLS CA: no certificates in %s", s.caFile)
+		}
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.clientCAs = pool
+	s.mu.Unlock()
+	return nil
+}
+
+// reload loads the files again. The current certificate stays in use if the
+// new files can't be loaded, e.g. while only one of them has been replaced.
+func (s *serverCerts) reload() {
+	if s == nil {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.Errorf("TLS reload error %v, keeping the current certificate", err)
+		return
+	}
+	log.Infof("Reloaded TLS certificate %s", s.certFile)
+}
+
+// tlsConfig returns the listener TLS config. Each handshake uses the
+// certificate and client CAs current at the time, so reloads apply to new
+// connections only. With a CA, clients must present a certificate it signed.
+// The minimum version and cipher suites are fixed at startup.
+func (s *serverCerts) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   s.minVersion,
+		CipherSuites: s.cipherSuites,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:   s.minVersion,
+				CipherSuites: s.cipherSuites,
+				Certificates: []tls.Certificate{*s.cert},
+				NextProtos:   []string{"h2"},
+			}
+			if s.clientCAs != nil {
+				cfg.ClientCAs = s.clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.VerifyConnection = s.verifyClient
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// parseTLSVersion parses Config.TLSMinVersion, empty meaning TLS 1.2.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid TLS minimum version %q, expected 1.2 or 1.3", version)
+	}
+}
+
+// parseCipherSuites maps Config.TLSCipherSuites to their IDs. Only the TLS
+// 1.2 suites Go considers secure are accepted.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		if slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			known[suite.Name] = suite.ID
+		}
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// verifyClient rejects the handshake unless the verified client certificate
+// has a URI SAN in allowedIDs or a DNS SAN in allowedDNSNames. With neither
+// list set every certificate the CA signed is accepted.
+func (s *serverCerts) verifyClient(cs tls.ConnectionState) error {
+	if len(s.allowedIDs) == 0 && len(s.allowedDNSNames) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	for _, uri := range leaf.URIs {
+		if slices.Contains(s.allowedIDs, uri.String()) {
+			return nil
+		}
+	}
+	for _, name := range leaf.DNSNames {
+		if slices.ContainsFunc(s.allowedDNSNames, func(allowed string) bool { return strings.EqualFold(allowed, name) }) {
+			return nil
+		}
+	}
+	clientCertsRejectedTotal.Inc()
+	log.Warnf("Rejected client certificate %q, no allowed SAN", leaf.Subject.String())
+	return fmt.Errorf("client certificate %q isn't allowed", leaf.Subject.String())
+}
+
+// close stops watching the files.
+func (s *serverCerts) close() {
+	if s == nil {
+		return
+	}
+	s.watcher.close()
+}
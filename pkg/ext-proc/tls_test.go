@@ -0,0 +1,52 @@
+package extproc
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+func TestValidateTLSSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"defaults", Config{}, false},
+		{"1.3", Config{TLSMinVersion: "1.3"}, false},
+		{"1.1", Config{TLSMinVersion: "1.1"}, true},
+		{"suites", Config{TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"}}, false},
+		{"unknown suite", Config{TLSCipherSuites: []string{"TLS_FANCY"}}, true},
+		{"insecure suite", Config{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, true},
+		{"1.3 suite", Config{TLSCipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, true},
+		{"suites with 1.3", Config{TLSMinVersion: "1.3", TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServerCertsTLSConfig(t *testing.T) {
+	cfg := &Config{TLSMinVersion: "1.2", TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &serverCerts{
+		cert:         &tls.Certificate{},
+		minVersion:   cfg.compiled.tlsMinVersion,
+		cipherSuites: cfg.compiled.tlsCipherSuites,
+	}
+
+	conn, err := s.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x, want TLS 1.2", conn.MinVersion)
+	}
+	if !slices.Equal(conn.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}) {
+		t.Errorf("CipherSuites = %x, want TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", conn.CipherSuites)
+	}
+}
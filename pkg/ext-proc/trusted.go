@@ -0,0 +1,81 @@
+package extproc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Secret is a configuration value that is never printed.
+type Secret string
+
+// String implements fmt.Stringer.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "***"
+}
+
+// MarshalText implements encoding.TextMarshaler so a Secret is redacted in
+// JSON and YAML too.
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// SignUpstream returns the Config.TrustedValidationHeader value vouching for
+// upstreamIP until expires: "<unix seconds>.<hex HMAC-SHA256>" under secret.
+// Binding the marker to the address means it can't be replayed for a
+// different upstream, and the expiry bounds how long it can be replayed for
+// the same one.
+func SignUpstream(secret Secret, upstreamIP string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + upstreamMAC(secret, upstreamIP, exp)
+}
+
+func upstreamMAC(secret Secret, upstreamIP, exp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("upstream:" + exp + ":" + upstreamIP))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TrustedHeaderDecider is the built-in Decider that allows a request whose
+// Config.TrustedValidationHeader carries a valid, unexpired SignUpstream
+// marker for its upstream IP, skipping the remaining IP checks because an
+// earlier hop has already made them. Missing, invalid or expired markers defer
+// to the rest of the chain.
+type TrustedHeaderDecider struct{}
+
+// Decide implements Decider.
+func (TrustedHeaderDecider) Decide(ctx context.Context, in *DecisionInput) (*Decision, error) {
+	name := in.Config.TrustedValidationHeader
+	if in.Phase != PhaseRequestHeaders || name == "" {
+		return nil, nil
+	}
+
+	marker := getHeader(in.Headers, name)
+	if marker == "" {
+		return nil, nil
+	}
+	ip, _, err := normalizeAddress(in.UpstreamIP)
+	if err != nil {
+		// Left to IPSafetyDecider.
+		return nil, nil
+	}
+
+	exp, mac, ok := strings.Cut(marker, ".")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || !hmac.Equal([]byte(mac), []byte(upstreamMAC(in.Config.TrustedValidationSecret, ip.String(), exp))) {
+		log.Debugf("Invalid %s marker for upstream %s", name, ip)
+		return nil, nil
+	}
+	if time.Now().Unix() > expires {
+		log.Debugf("Expired %s marker for upstream %s", name, ip)
+		return nil, nil
+	}
+	return &Decision{Allow: true, ReasonCode: ReasonTrustedHeader, MatchedRule: name}, nil
+}
@@ -0,0 +1,49 @@
+package extproc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrustedHeaderDecider(t *testing.T) {
+	const secret = Secret("s3cret")
+	cfg := &Config{TrustedValidationHeader: "X-Upstream-Validated", TrustedValidationSecret: secret}
+	useConfig(t, cfg)
+	valid := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name   string
+		marker string
+		want   ReasonCode
+	}{
+		{"valid", SignUpstream(secret, "10.0.0.1", valid), ReasonTrustedHeader},
+		{"expired", SignUpstream(secret, "10.0.0.1", time.Now().Add(-time.Minute)), ReasonPrivate},
+		{"other upstream", SignUpstream(secret, "10.0.0.2", valid), ReasonPrivate},
+		{"other secret", SignUpstream("other", "10.0.0.1", valid), ReasonPrivate},
+		{"no expiry", upstreamMAC(secret, "10.0.0.1", ""), ReasonPrivate},
+		{"garbage", "not-a-marker", ReasonPrivate},
+	}
+	for _, tt := range tests {
+		d := Evaluate(cfg, requestHeaders("10.0.0.1:8080", "x-upstream-validated", tt.marker))
+		if d.ReasonCode != tt.want {
+			t.Errorf("%s: ReasonCode = %s, want %s", tt.name, d.ReasonCode, tt.want)
+		}
+	}
+}
+
+func TestTrustedHeaderStripped(t *testing.T) {
+	const secret = Secret("s3cret")
+	cfg := useConfig(t, &Config{TrustedValidationHeader: "X-Upstream-Validated", TrustedValidationSecret: secret})
+	marker := SignUpstream(secret, "10.0.0.1", time.Now().Add(time.Minute))
+
+	resps := runStream(t, requestHeaders("10.0.0.1:8080", "X-Upstream-Validated", marker))
+	removed := resps[0].GetRequestHeaders().GetResponse().GetHeaderMutation().GetRemoveHeaders()
+	if len(removed) != 1 || removed[0] != "x-upstream-validated" {
+		t.Errorf("RemoveHeaders = %v, want [x-upstream-validated]", removed)
+	}
+
+	logged := redactedHeaders(cfg, headerMap("X-Upstream-Validated", marker))
+	if logged["x-upstream-validated"] != redactedValue {
+		t.Errorf("logged marker = %q, want it redacted", logged["x-upstream-validated"])
+	}
+}
@@ -1,6 +1,757 @@
 package extproc
 
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Policy modes.
+const (
+	// ModeHeuristic blocks the built-in unsafe ranges and DeniedCIDRs.
+	ModeHeuristic = "heuristic"
+	// ModeAllowlistOnly blocks every upstream outside AllowedCIDRs.
+	ModeAllowlistOnly = "allowlist-only"
+)
+
+// Handling of malformed x-forwarded-for hops.
+const (
+	ForwardedForBlock = "block"
+	ForwardedForSkip  = "skip"
+)
+
+// Responses to streams rejected for overload.
+const (
+	OverloadGrpcError         = "grpc-error"
+	OverloadImmediateResponse = "immediate-response"
+)
+
+// Handling of requests without a content type when content type policy is
+// configured.
+const (
+	MissingContentTypeAllow = "allow"
+	MissingContentTypeBlock = "block"
+)
+
+// Block response body formats.
+const (
+	BlockFormatText    = "text"
+	BlockFormatProblem = "problem+json"
+)
+
+// Handling of requests whose upstream address can't be extracted.
+const (
+	FailureModeClosed = "closed"
+	FailureModeOpen   = "open"
+)
+
+// Handling of upstream addresses that don't parse.
+const (
+	InvalidAddressBlock = "block"
+	InvalidAddressAllow = "allow"
+	InvalidAddressLog   = "log"
+)
+
+// Handling of streams that exceed MaxBodyChunks.
+const (
+	BodyChunksBlock = "block"
+	BodyChunksAllow = "allow"
+	BodyChunksLog   = "log"
+)
+
+// Handling of body decisions that can't be completed.
+const (
+	InconclusiveBodyBlock = "block"
+	InconclusiveBodyAllow = "allow"
+	InconclusiveBodyLog   = "log"
+)
+
+// Actions for ResponseStatusRule.
+const (
+	ResponseStatusContinue  = "continue"
+	ResponseStatusAddHeader = "add-header"
+	ResponseStatusBlock     = "block"
+)
+
+// ResponseStatusRule applies Action to upstream responses whose :status is
+// between Min and Max inclusive.
+type ResponseStatusRule struct {
+	Min, Max int
+	Action   string
+	// HeaderName and HeaderValue are set on the response by
+	// ResponseStatusAddHeader.
+	HeaderName  string
+	HeaderValue string
+}
+
+// AttributeSource is a field path within an Envoy attribute namespace, e.g.
+// upstream.address in envoy.filters.http.ext_proc.
+type AttributeSource struct {
+	Namespace string
+	Path      string
+}
+
+func (s AttributeSource) String() string {
+	return s.Namespace + ":" + s.Path
+}
+
 // Config defines the configuration needed for Envoy External Processing
 type Config struct {
 	Port uint32
+	// BindAddress is the address the gRPC listener binds to.
+	BindAddress string
+	// Listen, when set, is the gRPC listener address instead of BindAddress
+	// and Port: unix:///path/to/socket for a unix domain socket, or
+	// tcp://host:port. The debug endpoints still use BindAddress.
+	Listen string
+	// SocketMode is the permission of the unix socket, 0660 by default.
+	SocketMode os.FileMode
+	// TLSCert and TLSKey serve the gRPC listener over TLS instead of
+	// plaintext. With TLSCA, clients must also present a certificate signed
+	// by it (mTLS). The files are reloaded when they change or on SIGHUP;
+	// new connections use the reloaded certificate.
+	TLSCert string
+	TLSKey  string
+	TLSCA   string
+	// TLSAllowedSPIFFEIDs and TLSAllowedDNSNames only accept client
+	// certificates with one of these URI SANs (e.g.
+	// spiffe://cluster.local/ns/envoy/sa/gateway) or DNS SANs, rejecting
+	// others at the handshake. They need TLSCA.
+	TLSAllowedSPIFFEIDs []string
+	TLSAllowedDNSNames  []string
+	// TLSMinVersion is the lowest TLS version accepted, "1.2" (default) or
+	// "1.3".
+	TLSMinVersion string
+	// TLSCipherSuites, when set, restricts TLS 1.2 connections to these
+	// cipher suites, by their Go names (e.g.
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256). TLS 1.3 suites aren't
+	// configurable. Unknown and insecure suites are rejected.
+	TLSCipherSuites []string
+	// Network is the listener network, tcp (default), tcp4 or tcp6. tcp4
+	// and tcp6 force the address family, which must match BindAddress.
+	Network string
+	// DualStack binds [::] so both IPv4 and IPv6 clients are accepted. It
+	// requires a wildcard BindAddress and can't be combined with ReusePort.
+	DualStack bool
+	// ReusePort sets SO_REUSEPORT on the gRPC listeners so several instances
+	// can share a port. Ignored with a warning where unsupported.
+	ReusePort bool
+	// MaxStreams rejects new streams with Unavailable while this many are
+	// already open. Zero disables the limit.
+	MaxStreams int
+	// OverloadResponse is how streams over MaxStreams are rejected:
+	// OverloadGrpcError (default) ends them with Unavailable so Envoy applies
+	// its failure_mode_allow, OverloadImmediateResponse blocks the request
+	// with OverloadStatusCode (default 503).
+	OverloadResponse   string
+	OverloadStatusCode int
+	// OverloadRetryAfter, when set, is sent as retry-after on the immediate
+	// response or as gRPC trailer metadata.
+	OverloadRetryAfter string
+	// PerStreamMsgRate limits how many messages per second a single stream
+	// is processed at. Messages beyond it are delayed, not dropped, with a
+	// burst of one second's worth. Zero disables the limit.
+	PerStreamMsgRate float64
+	// WorkerPoolSize runs decisions on this many shared goroutines instead of
+	// on each stream's goroutine. Zero decides on the stream goroutine.
+	WorkerPoolSize int
+	// DebugPort serves the debug HTTP endpoints and Prometheus metrics. Zero
+	// disables them.
+	DebugPort uint32
+	// RecentBlocksSize is how many blocked decisions /recent-blocks keeps.
+	RecentBlocksSize int
+	// DebugReadHeaderTimeout, DebugReadTimeout, DebugWriteTimeout and
+	// DebugIdleTimeout bound the debug server's connections. Zero uses 5s,
+	// 10s, 30s and 60s respectively.
+	DebugReadHeaderTimeout time.Duration
+	DebugReadTimeout       time.Duration
+	DebugWriteTimeout      time.Duration
+	DebugIdleTimeout       time.Duration
+	// AuditLogFile appends a JSON line per blocked decision to this file.
+	// It is reopened on SIGHUP for log rotation.
+	AuditLogFile string
+	// AuditAllowed also writes allowed decisions to the audit log.
+	AuditAllowed bool
+	// AuditFormat is the record format of the audit log and the built-in
+	// event sinks: AuditFormatJSON (default), AuditFormatCEF or
+	// AuditFormatLEEF.
+	AuditFormat string
+	// ForensicCaptureRates maps a reason code to the fraction (0.0-1.0) of
+	// blocks with that code whose redacted request headers are included in
+	// the audit log and events, e.g. METADATA=1, PRIVATE=0.01. Unlisted
+	// codes are never captured.
+	ForensicCaptureRates map[string]float64
+	// EnableReflection registers the gRPC reflection service. Disable it to
+	// avoid exposing the service schema.
+	EnableReflection bool
+	// EnableHealthService registers the gRPC health service.
+	EnableHealthService bool
+	// StartupGracePeriod keeps the readiness health service NOT_SERVING for
+	// this long after the listeners are up, so lazily warmed caches can fill
+	// before Envoy routes traffic here.
+	StartupGracePeriod time.Duration
+	// MaxRequests shuts the processor down cleanly, as SIGTERM does, once it
+	// has decided this many requests, so canaries can be recycled. Streams
+	// still in flight are drained. Zero means no limit.
+	MaxRequests int64
+	// LogRequestHeaders logs the inbound request headers in the header phase.
+	LogRequestHeaders bool
+	// TraceIPChecks logs each IP safety check evaluated for a request and
+	// its outcome at debug level. The /explain?ip= debug endpoint returns the
+	// same trail for any address.
+	TraceIPChecks bool
+	// RequestIDHeader is the header decisions are correlated by in logs,
+	// events and metadata. Empty means x-request-id.
+	RequestIDHeader string
+	// GenerateRequestID generates a UUID for requests without
+	// RequestIDHeader and adds it to the request on allow. It is also in the
+	// decision metadata and records either way.
+	GenerateRequestID bool
+	// LogSampleRate is the fraction (0.0-1.0) of allowed decisions logged in
+	// detail. Blocks are always logged.
+	LogSampleRate float64
+	// RedactHeaders lists headers, matched case-insensitively, whose values
+	// are replaced with *** when logged.
+	RedactHeaders []string
+	// Mode selects the IP policy, ModeHeuristic (default) or ModeAllowlistOnly.
+	Mode string
+	// AllowedCIDRs are upstream ranges that are always allowed. They take
+	// precedence over DeniedCIDRs and the built-in checks.
+	AllowedCIDRs []string
+	// DeniedCIDRs are upstream ranges that are always blocked.
+	DeniedCIDRs []string
+	// ReservedRanges overrides whether each named special-purpose range
+	// (loopback, private, cgnat, documentation, ...) is blocked. Unlisted
+	// ranges use their secure default, which is to block, except nat64
+	// where the embedded IPv4 address is checked instead.
+	ReservedRanges map[string]bool
+	// ReverseLookup also blocks upstreams whose reverse DNS (PTR) names match
+	// DeniedHosts. Each lookup is bounded by ReverseLookupTimeout (default
+	// 500ms).
+	ReverseLookup        bool
+	ReverseLookupTimeout time.Duration
+	// ReverseLookupCacheTTL is how long reverse lookup results, failures
+	// included, are cached (default 5m). It is a fixed TTL: the Go resolver
+	// doesn't expose record TTLs, so they aren't honored. The cache only
+	// covers reverse lookups, the processor does no other DNS resolution.
+	ReverseLookupCacheTTL time.Duration
+	// ReverseLookupMaxInFlight is the old name of MaxConcurrentChecks, used
+	// when that is zero.
+	//
+	// Deprecated: use MaxConcurrentChecks.
+	ReverseLookupMaxInFlight int
+	// MaxConcurrentChecks limits how many outbound checks, currently reverse
+	// lookups, run at once across all streams. Concurrent lookups of the same
+	// address always share one query. A decision waits for a slot until its
+	// context is done, bounded by DecisionTimeout and the stream deadline,
+	// or the lookup timeout; it is then blocked with CHECKS_SATURATED and a
+	// 503, or continues without the check with FailureModeOpen. Zero means
+	// no limit.
+	MaxConcurrentChecks int
+	// ReverseLookupFailClosed blocks when a reverse lookup fails. Otherwise a
+	// failed lookup is ignored.
+	ReverseLookupFailClosed bool
+	// PolicyFile is a YAML or JSON Policy document overriding the CIDR lists,
+	// AllowMetadataService, BlockStatusCode and BlockBody. It is reloaded
+	// when it changes; an invalid update is logged and the previous policy
+	// kept. In-flight streams pick up the new policy for their next decision.
+	PolicyFile string
+	// AllowMetadataService allows the cloud metadata service addresses
+	// (169.254.169.254 and fd00:ec2::254) even though link-local and
+	// private addresses are blocked, for environments that front it with a
+	// hardened proxy. DeniedCIDRs still apply. Listing the address in
+	// AllowedCIDRs also allows it. Off by default.
+	AllowMetadataService bool
+	// AllowLoopback skips the loopback block unless ReservedRanges sets
+	// loopback explicitly. For local development only.
+	AllowLoopback bool
+	// AttributeSources are the (namespace, field path) pairs searched for the
+	// upstream address, in order. They're tried before AttributeNamespaces.
+	AttributeSources []AttributeSource
+	// AttributeNamespaces are Envoy attribute namespaces searched for
+	// AttributePath, in order. The ext_proc namespace is always tried last.
+	AttributeNamespaces []string
+	// AttributePath is the dotted field path of the upstream address within
+	// AttributeNamespaces. Defaults to upstream.address.
+	AttributePath string
+	// AllowMissingAttributes allows requests for which Envoy attached no
+	// ext_proc attributes at all, usually a filter misconfiguration, with a
+	// warning. A present but empty upstream.address is still blocked.
+	AllowMissingAttributes bool
+	// FailureMode is FailureModeClosed (default), which blocks requests
+	// whose upstream address can't be extracted, or FailureModeOpen, which
+	// lets them continue with a fail-open warning. Open also covers requests
+	// without any attributes, as AllowMissingAttributes does.
+	FailureMode string
+	// InvalidAddress is InvalidAddressBlock (default), InvalidAddressAllow or
+	// InvalidAddressLog, which also allows but with a warning, for an
+	// upstream address attribute that is present but doesn't parse. That is
+	// usually an attribute encoding problem rather than an attack.
+	InvalidAddress string
+	// CheckForwardedFor also runs every x-forwarded-for hop through the IP
+	// safety checks and blocks if any is unsafe.
+	CheckForwardedFor bool
+	// ForwardedForMalformed is ForwardedForBlock (default) or ForwardedForSkip
+	// for hops that don't parse as an IP.
+	ForwardedForMalformed string
+	// BlockStatusCode replaces the default 403 of block responses. Blocks
+	// with their own status, such as 405 or 431, keep it.
+	BlockStatusCode int
+	// BlockBody replaces the generic message sent as the body of non-gRPC
+	// block responses. It is a text/template with .UpstreamIP, .ReasonCode,
+	// .Reason, .MatchedRule, .RequestID and .StatusCode, e.g. a JSON error
+	// envelope. Values are inserted as is; use the json function to quote
+	// and escape them in JSON, e.g. {"error": {{json .ReasonCode}}}. .Reason
+	// and .MatchedRule expose policy detail to clients; without them the
+	// reason is only in the response details, metadata and logs.
+	BlockBody string
+	// BlockFormat is BlockFormatText (default), which sends BlockBody or a
+	// generic message, or BlockFormatProblem, which sends an RFC 7807
+	// application/problem+json document with the reason code and request
+	// id instead of BlockBody and BlockContentType.
+	BlockFormat string
+	// BlockHeaders are added to every block response.
+	BlockHeaders map[string]string
+	// BlockContentType is the content-type of block response bodies,
+	// text/plain by default.
+	BlockContentType string
+	// BlockGrpcStatus, when set, populates ImmediateResponse.GrpcStatus on
+	// block and is used as the grpc-status for gRPC clients.
+	BlockGrpcStatus *uint32
+	// MaxRequestHeaders blocks requests with more headers than this with a
+	// 431. Zero disables the limit.
+	MaxRequestHeaders int
+	// MaxHeaderBytes blocks requests whose header names and values total
+	// more than this many bytes with a 431. Zero disables the limit.
+	MaxHeaderBytes int
+	// MaxBodyChunks is how many body chunks either direction of a stream may
+	// send without end of stream before BodyChunksExceeded applies. Zero
+	// disables the limit.
+	MaxBodyChunks int
+	// BodyChunksExceeded is BodyChunksBlock (default), BodyChunksAllow or
+	// BodyChunksLog, which also allows but with a warning. Once tripped the
+	// stream's chunks are no longer counted.
+	BodyChunksExceeded string
+	// AllowedMethods, when set, blocks requests whose :method isn't listed
+	// with a 405. Matching is case-sensitive. Empty allows every method.
+	AllowedMethods []string
+	// DeniedContentTypes blocks requests with these content types, and
+	// AllowedContentTypes, when set, blocks every other type, with a 415.
+	// Parameters such as charset are ignored.
+	DeniedContentTypes  []string
+	AllowedContentTypes []string
+	// MissingContentType is MissingContentTypeAllow (default) or
+	// MissingContentTypeBlock for requests without a content type when
+	// either list is set.
+	MissingContentType string
+	// DeniedHosts blocks requests whose :authority matches one of these
+	// patterns. "*" matches any run of characters, e.g. "*.svc.cluster.local".
+	DeniedHosts []string
+	// EnforceAuthoritySNIMatch blocks requests whose :authority host differs
+	// from the TLS server name in the connection.requested_server_name
+	// attribute, which must be listed in the filter's request_attributes.
+	// Requests without an SNI, such as plaintext ones, aren't checked.
+	EnforceAuthoritySNIMatch bool
+	// DeniedClusters blocks requests routed to these upstream clusters, by
+	// the xds.cluster_name attribute, regardless of the upstream IP.
+	DeniedClusters []string
+	// AllowedClusters allows requests routed to these upstream clusters
+	// without the IP checks, unless the cluster is also denied.
+	AllowedClusters []string
+	// GeoIPDBPath is a MaxMind format (mmdb) country and/or ASN database the
+	// upstream IP is looked up in for DeniedCountries and DeniedASNs. It is
+	// reopened on SIGHUP. Empty skips the lookup.
+	GeoIPDBPath string
+	// DeniedCountries blocks upstreams in these ISO 3166 countries. It
+	// requires GeoIPDBPath.
+	DeniedCountries []string
+	// DeniedASNs blocks upstreams in these autonomous systems. It requires
+	// GeoIPDBPath.
+	DeniedASNs []uint
+	// TrustedValidationHeader names a header an earlier hop sets to
+	// SignUpstream(TrustedValidationSecret, upstream IP, expiry) once it has
+	// validated the upstream. A request with a valid, unexpired marker is
+	// allowed without the IP safety checks; others are evaluated as usual.
+	// The header is always redacted in logs and removed from allowed
+	// requests before they are forwarded.
+	TrustedValidationHeader string
+	// TrustedValidationSecret is the HMAC key for TrustedValidationHeader.
+	TrustedValidationSecret Secret
+	// BypassHeader names a header carrying a SignBypass(BypassSecret,
+	// authority, expiry) token. A request to that host with a valid,
+	// unexpired token is processed in dry-run: blocks are logged, audited
+	// and counted as bypassed but the request and its response continue.
+	// Invalid tokens, and tokens signed for another host, are ignored.
+	// Meant for incident response. Like TrustedValidationHeader it is always
+	// redacted in logs and removed from allowed requests before they are
+	// forwarded.
+	BypassHeader string
+	// BypassSecret is the HMAC key for BypassHeader.
+	BypassSecret Secret
+	// DebugDecisionHeader adds an x-extproc-decision header with the verdict
+	// to the request on allow, the immediate response on block, and the
+	// upstream response when the response header phase is processed. It
+	// exposes policy detail, so it is meant for troubleshooting only.
+	DebugDecisionHeader bool
+	// ResponseVerdictHeader names a header set on the upstream response to
+	// the request decision's reason code and matched rule, e.g.
+	// "ALLOWED_CIDR; rule=10.0.0.0/8". Empty disables it. Like the other
+	// response headers it needs the response header phase to be processed.
+	ResponseVerdictHeader string
+	// EchoRequestID sets the request id, received or generated, on the
+	// upstream response too.
+	EchoRequestID bool
+	// ContinueAndReplace answers header phases that carry a header mutation
+	// with CONTINUE_AND_REPLACE instead of CONTINUE. Envoy applies the
+	// mutation and sends no further messages for that direction, so body
+	// and trailer phases, and MaxBodyChunks, no longer apply to it. For
+	// request headers the route cache is also cleared so Envoy recomputes
+	// the route from the mutated headers, which may select a different
+	// cluster than the one whose address was checked; Envoy only honours
+	// this when the filter's route_cache_action allows it.
+	ContinueAndReplace bool
+	// MetadataNamespace nests the emitted dynamic metadata under this key.
+	// Empty keeps the fields at the top level.
+	MetadataNamespace string
+	// DecisionTimeout bounds how long the Decider chain may take. Zero means
+	// no deadline.
+	DecisionTimeout time.Duration
+	// TimeoutHeader names a request header carrying a per-request decision
+	// timeout in milliseconds that overrides DecisionTimeout.
+	TimeoutHeader string
+	// MaxDecisionTimeout caps the timeout taken from TimeoutHeader.
+	MaxDecisionTimeout time.Duration
+	// ResponseRemoveHeaders lists headers stripped from upstream responses
+	// in the response header phase.
+	ResponseRemoveHeaders []string
+	// ResponseDeniedContentTypes blocks upstream responses with any of these
+	// content types, regardless of the request verdict.
+	ResponseDeniedContentTypes []string
+	// ResponseStatusRules act on upstream responses by status code. The first
+	// rule whose range contains the status applies: ResponseStatusContinue
+	// lets the response through, ResponseStatusAddHeader adds a header and
+	// ResponseStatusBlock replaces it with a 502, regardless of the request
+	// verdict.
+	ResponseStatusRules []ResponseStatusRule
+	// EventSinkURL is the broker decision events are published to, e.g.
+	// nats://localhost:4222. Empty disables publishing unless EventSink is
+	// set.
+	EventSinkURL string
+	// EventSinkSubject is the subject events are published on.
+	EventSinkSubject string
+	// EventSinkBuffer is how many events are queued for the sink before new
+	// ones are dropped.
+	EventSinkBuffer int
+	// EventSinkAllowed also sends allowed decisions, not only blocks.
+	EventSinkAllowed bool
+	// EventSink overrides the sink built from EventSinkURL.
+	EventSink EventSink
+	// ProbeDependenciesOnStart checks at startup that dependencies such as
+	// the event sink are reachable, each within ProbeTimeout (default 5s),
+	// and logs the results. With ProbeRequired a failed probe fails Init.
+	ProbeDependenciesOnStart bool
+	ProbeTimeout             time.Duration
+	ProbeRequired            bool
+	// IPCheckers replaces the built-in IP safety checks used by
+	// IPSafetyDecider and ForwardedForDecider with this chain. Include a
+	// BuiltinIPChecker{} to keep the built-in checks alongside custom ones.
+	IPCheckers []IPSafetyChecker
+	// InspectBodies runs the Deciders on request and response body messages
+	// of allowed requests too, with the PhaseRequestBody and
+	// PhaseResponseBody phases. A Decider that blocks ends the stream; no
+	// verdict lets the chunk through. Envoy only sends bodies when the
+	// filter's processing_mode asks for them.
+	InspectBodies bool
+	// BodyInspectors run on the response body messages of allowed requests
+	// and may replace the body rather than block, see BodyInspector. With
+	// any set, content-length is removed from upstream responses since a
+	// replacement changes the length. Envoy only sends bodies when the
+	// filter's processing_mode asks for them.
+	BodyInspectors []BodyInspector
+	// InconclusiveBody is InconclusiveBodyBlock (default),
+	// InconclusiveBodyAllow or InconclusiveBodyLog, which also allows but
+	// with a warning, for a body decision that can't be completed: a Decider
+	// returned ErrInconclusive, typically for a partially buffered body, or
+	// the stream ended part way through a body, e.g. because the connection
+	// dropped. In the second case the chunks received have already been let
+	// through and nothing more can be sent, so block only logs the decision
+	// and records it in the audit log and events as a block.
+	InconclusiveBody string
+	// Deciders is the ordered chain evaluated for each phase. When empty the
+	// built-in HeaderLimitDecider, MethodPolicyDecider,
+	// ContentTypePolicyDecider, HostPolicyDecider, ClusterPolicyDecider,
+	// TrustedHeaderDecider, GeoPolicyDecider, ForwardedForDecider,
+	// ReverseLookupDecider, IPSafetyDecider and ResponsePolicyDecider are
+	// used.
+	Deciders []Decider
+
+	// compiled holds state derived from the fields above by Validate.
+	compiled *compiledConfig
+}
+
+// compiledConfig is the parsed form of the list settings in Config.
+type compiledConfig struct {
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+
+	allowedNets   *cidrTrie
+	deniedNets    *cidrTrie
+	redactHeaders map[string]bool
+	deniedHosts   *hostMatcher
+
+	reservedRanges []reservedRange
+
+	attributeSources []AttributeSource
+
+	reverseLookups *reverseLookupCache
+
+	blockBody *template.Template
+}
+
+// Validate checks the config and prepares the state derived from it. Init
+// calls it; call it directly when using Evaluate without Init.
+func (c *Config) Validate() error {
+	if c.PerStreamMsgRate < 0 {
+		return fmt.Errorf("invalid per-stream message rate %v", c.PerStreamMsgRate)
+	}
+	if c.MaxRequests < 0 {
+		return fmt.Errorf("invalid max requests %d", c.MaxRequests)
+	}
+	if c.StartupGracePeriod < 0 {
+		return fmt.Errorf("invalid startup grace period %v", c.StartupGracePeriod)
+	}
+	if c.MaxConcurrentChecks < 0 {
+		return fmt.Errorf("invalid max concurrent checks %d", c.MaxConcurrentChecks)
+	}
+
+	if c.LogSampleRate < 0 || c.LogSampleRate > 1 {
+		return fmt.Errorf("invalid log sample rate %v, must be between 0 and 1", c.LogSampleRate)
+	}
+
+	for code, rate := range c.ForensicCaptureRates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid forensic capture rate %v for %s, must be between 0 and 1", rate, code)
+		}
+	}
+
+	for _, r := range c.ResponseStatusRules {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key")
+	}
+	if c.TLSCA != "" && c.TLSCert == "" {
+		return fmt.Errorf("TLS CA %s needs a certificate and key", c.TLSCA)
+	}
+	if (len(c.TLSAllowedSPIFFEIDs) > 0 || len(c.TLSAllowedDNSNames) > 0) && c.TLSCA == "" {
+		return fmt.Errorf("client certificate SAN allowlists need a TLS CA")
+	}
+	tlsMinVersion, err := parseTLSVersion(c.TLSMinVersion)
+	if err != nil {
+		return err
+	}
+	tlsCipherSuites, err := parseCipherSuites(c.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+	if len(tlsCipherSuites) > 0 && tlsMinVersion == tls.VersionTLS13 {
+		return fmt.Errorf("TLS cipher suites only apply to TLS 1.2, not with minimum version 1.3")
+	}
+	if err := validateNetwork(c); err != nil {
+		return err
+	}
+	if err := validateListen(c); err != nil {
+		return err
+	}
+
+	switch c.AuditFormat {
+	case "", AuditFormatJSON, AuditFormatCEF, AuditFormatLEEF:
+	default:
+		return fmt.Errorf("invalid audit format %q", c.AuditFormat)
+	}
+
+	switch c.Mode {
+	case "", ModeHeuristic, ModeAllowlistOnly:
+	default:
+		return fmt.Errorf("invalid mode %q", c.Mode)
+	}
+
+	switch c.ForwardedForMalformed {
+	case "", ForwardedForBlock, ForwardedForSkip:
+	default:
+		return fmt.Errorf("invalid malformed x-forwarded-for handling %q", c.ForwardedForMalformed)
+	}
+
+	switch c.OverloadResponse {
+	case "", OverloadGrpcError, OverloadImmediateResponse:
+	default:
+		return fmt.Errorf("invalid overload response %q", c.OverloadResponse)
+	}
+	if c.OverloadStatusCode != 0 && (c.OverloadStatusCode < 400 || c.OverloadStatusCode > 599) {
+		return fmt.Errorf("invalid overload status code %d", c.OverloadStatusCode)
+	}
+
+	switch c.MissingContentType {
+	case "", MissingContentTypeAllow, MissingContentTypeBlock:
+	default:
+		return fmt.Errorf("invalid missing content type handling %q", c.MissingContentType)
+	}
+
+	switch c.FailureMode {
+	case "", FailureModeClosed, FailureModeOpen:
+	default:
+		return fmt.Errorf("invalid failure mode %q, expected open or closed", c.FailureMode)
+	}
+
+	switch c.InvalidAddress {
+	case "", InvalidAddressBlock, InvalidAddressAllow, InvalidAddressLog:
+	default:
+		return fmt.Errorf("invalid malformed address handling %q", c.InvalidAddress)
+	}
+
+	switch c.InconclusiveBody {
+	case "", InconclusiveBodyBlock, InconclusiveBodyAllow, InconclusiveBodyLog:
+	default:
+		return fmt.Errorf("invalid inconclusive body handling %q", c.InconclusiveBody)
+	}
+
+	switch c.BodyChunksExceeded {
+	case "", BodyChunksBlock, BodyChunksAllow, BodyChunksLog:
+	default:
+		return fmt.Errorf("invalid body chunk limit handling %q", c.BodyChunksExceeded)
+	}
+
+	if c.BypassHeader != "" && c.BypassSecret == "" {
+		return fmt.Errorf("bypass header %q requires a secret", c.BypassHeader)
+	}
+	if c.TrustedValidationHeader != "" && c.TrustedValidationSecret == "" {
+		return fmt.Errorf("trusted validation header %q requires a secret", c.TrustedValidationHeader)
+	}
+	if (len(c.DeniedCountries) > 0 || len(c.DeniedASNs) > 0) && c.GeoIPDBPath == "" {
+		return fmt.Errorf("denied countries and ASNs require a GeoIP database")
+	}
+
+	switch c.BlockFormat {
+	case "", BlockFormatText, BlockFormatProblem:
+	default:
+		return fmt.Errorf("invalid block format %q, expected text or problem+json", c.BlockFormat)
+	}
+	if c.BlockStatusCode != 0 && (c.BlockStatusCode < 400 || c.BlockStatusCode > 599) {
+		return fmt.Errorf("invalid block status code %d", c.BlockStatusCode)
+	}
+	if c.BlockGrpcStatus != nil && *c.BlockGrpcStatus > uint32(codes.Unauthenticated) {
+		return fmt.Errorf("invalid block gRPC status %d", *c.BlockGrpcStatus)
+	}
+
+	compiled := &compiledConfig{
+		tlsMinVersion:   tlsMinVersion,
+		tlsCipherSuites: tlsCipherSuites,
+		redactHeaders:   make(map[string]bool, len(c.RedactHeaders)),
+	}
+
+	for _, h := range c.RedactHeaders {
+		compiled.redactHeaders[strings.ToLower(h)] = true
+	}
+	for _, h := range c.markerHeaders() {
+		compiled.redactHeaders[h] = true
+	}
+
+	allowed, err := parseCIDRs(c.AllowedCIDRs)
+	if err != nil {
+		return err
+	}
+	compiled.allowedNets = newCIDRTrie(allowed)
+
+	denied, err := parseCIDRs(c.DeniedCIDRs)
+	if err != nil {
+		return err
+	}
+	compiled.deniedNets = newCIDRTrie(denied)
+
+	if compiled.deniedHosts, err = compileHostPatterns(c.DeniedHosts); err != nil {
+		return err
+	}
+	if compiled.reservedRanges, err = compileReservedRanges(c); err != nil {
+		return err
+	}
+
+	if compiled.attributeSources, err = compileAttributeSources(c); err != nil {
+		return err
+	}
+
+	if c.BlockBody != "" {
+		if compiled.blockBody, err = template.New("blockBody").Funcs(blockBodyFuncs).Parse(c.BlockBody); err != nil {
+			return fmt.Errorf("invalid block body template: %w", err)
+		}
+	}
+
+	if c.ReverseLookup {
+		maxChecks := c.MaxConcurrentChecks
+		if maxChecks == 0 {
+			maxChecks = c.ReverseLookupMaxInFlight
+		}
+		compiled.reverseLookups = newReverseLookupCache(c.ReverseLookupCacheTTL, c.ReverseLookupTimeout, maxChecks)
+	}
+
+	c.compiled = compiled
+	return nil
+}
+
+// Redacted returns a copy of the config that is safe to print, with the
+// userinfo of EventSinkURL hidden. Secret fields always print redacted.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.EventSinkURL = redactURL(c.EventSinkURL)
+	return &r
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// compileAttributeSources flattens the attribute settings into the ordered
+// source list, ending with the ext_proc namespace as a fallback.
+func compileAttributeSources(c *Config) ([]AttributeSource, error) {
+	path := c.AttributePath
+	if path == "" {
+		path = defaultAttributePath
+	}
+
+	var sources []AttributeSource
+	seen := map[AttributeSource]bool{}
+	add := func(src AttributeSource) {
+		if !seen[src] {
+			seen[src] = true
+			sources = append(sources, src)
+		}
+	}
+
+	for _, src := range c.AttributeSources {
+		if src.Namespace == "" || src.Path == "" {
+			return nil, fmt.Errorf("invalid attribute source %q, expected namespace:path", src)
+		}
+		add(src)
+	}
+	for _, ns := range c.AttributeNamespaces {
+		add(AttributeSource{Namespace: ns, Path: path})
+	}
+	add(AttributeSource{Namespace: extProcAttributes, Path: path})
+	return sources, nil
 }
@@ -0,0 +1,70 @@
+package extproc
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileWatcher calls a function when any of a set of files changes. A nil
+// *fileWatcher does nothing.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// watchFiles starts watching paths. Their directories are watched rather than
+// the files so editors that replace a file, and Kubernetes ConfigMap and
+// Secret updates, which swap a symlink, are seen too. onChange runs on the
+// watcher goroutine.
+func watchFiles(paths []string, onChange func()) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		names[path] = true
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	w := &fileWatcher{watcher: watcher, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				// Kubernetes swaps the ..data symlink the files point through.
+				if names[filepath.Clean(event.Name)] || strings.HasPrefix(filepath.Base(event.Name), "..") {
+					onChange()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("file watch error %v", err)
+			}
+		}
+	}()
+	return w, nil
+}
+
+// close stops watching.
+func (w *fileWatcher) close() {
+	if w == nil {
+		return
+	}
+	w.watcher.Close()
+	<-w.done
+}